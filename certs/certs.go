@@ -0,0 +1,120 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"spa-api/logging"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Config
+
+var ErrNoCertificates = errors.New("no certificates in the CA file")
+
+// TLS certificate of the server, loaded from the certificate and key
+// files and reloaded when they change, so a renewed certificate is
+// served without a restart.
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time // latest modification of the files
+}
+
+// Loads the certificate. The files must be valid at the start.
+func Load(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Loads the certificate again if a file was modified since the last
+// load. Reports whether the certificate was replaced. A pair that does
+// not match, for example while the files are being written, is an
+// error and the previous certificate stays.
+func (r *Reloader) Reload() (bool, error) {
+	modified, err := r.modTime()
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	current := r.cert != nil && !modified.After(r.modified)
+	r.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modified = modified
+	r.mu.Unlock()
+	return true, nil
+}
+
+func (r *Reloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Checks the files for changes until the stop channel is closed.
+func (r *Reloader) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				log.Error(logging.F()+"() cannot reload certificate:", err)
+			} else if reloaded {
+				log.WithFields(logrus.Fields{
+					"file": r.CertFile,
+				}).Info(logging.F() + "() certificate reloaded:")
+			}
+		}
+	}
+}
+
+// Certificate callback of tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reads the PEM certificates of the certificate authorities that issue
+// client certificates.
+func CAPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, ErrNoCertificates
+	}
+	return pool, nil
+}
@@ -0,0 +1,522 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Settings of the application. Every setting has a YAML key, an
+// environment variable and a command line flag named by the YAML path,
+// for example "-db.host". Secret settings are masked in the dump.
+// Settings tagged reload are applied at runtime when the file changes,
+// others require a restart.
+type Config struct {
+	Mode      string    `yaml:"mode" env:"GIN_MODE"` // debug, release or test
+	Server    Server    `yaml:"server"`
+	TLS       TLS       `yaml:"tls"`
+	Log       Log       `yaml:"log"`
+	Tracing   Tracing   `yaml:"tracing"`
+	DB        DB        `yaml:"db"`
+	Security  Security  `yaml:"security"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	JWT       JWT       `yaml:"jwt"`
+	Auth      Auth      `yaml:"auth"`
+	LDAP      LDAP      `yaml:"ldap"`
+	OIDC      OIDC      `yaml:"oidc"`
+	Mail      Mail      `yaml:"mail"`
+	Password  Password  `yaml:"password"`
+	Storage   Storage   `yaml:"storage"`
+	Webhooks  Webhooks  `yaml:"webhooks"`
+
+	file string // loaded configuration file
+}
+
+type Server struct {
+	Addr               string   `yaml:"addr" env:"SERVER_ADDR"`
+	TrustedProxies     []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	MaxMultipartMemory int64    `yaml:"max_multipart_memory" env:"MAX_MULTIPART_MEMORY"` // bytes
+	// Plain HTTP listener of /metrics and /healthz, loopback by
+	// default. The main listener serves them to admins if empty.
+	MetricsAddr string `yaml:"metrics_addr" env:"METRICS_ADDR"`
+
+	// Timeouts of http.Server, 0 is unlimited. Uploads, downloads of
+	// large files and event streams need unlimited read and write
+	// timeouts.
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT"`
+	// Time for requests in progress after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+// Native HTTPS. The certificate is reloaded when its files change.
+type TLS struct {
+	CertFile     string `yaml:"cert_file" env:"TLS_CERT_FILE"` // plain HTTP if empty
+	KeyFile      string `yaml:"key_file" env:"TLS_KEY_FILE"`
+	ClientAuth   string `yaml:"client_auth" env:"TLS_CLIENT_AUTH"` // none, optional or require
+	ClientCAFile string `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	// API keys are accepted only with a verified client certificate.
+	APIKeyClientCert bool `yaml:"api_key_client_cert" env:"TLS_API_KEY_CLIENT_CERT"`
+	// Plain HTTP listener that redirects to HTTPS, disabled if empty.
+	RedirectAddr string `yaml:"redirect_addr" env:"TLS_REDIRECT_ADDR"`
+}
+
+// Reports whether the server listens on HTTPS.
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Logging to the console, a rotated file and syslog. Every sink has a
+// level, the default is Level. Empty targets disable the sinks.
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_MODE" reload:"true"`
+	Format string `yaml:"format" env:"LOG_FORMAT" reload:"true"` // text or json
+
+	Console      string `yaml:"console" env:"LOG_CONSOLE"` // stdout or stderr
+	ConsoleLevel string `yaml:"console_level" env:"LOG_CONSOLE_LEVEL" reload:"true"`
+
+	File       string `yaml:"file" env:"LOG_FILE"`
+	FileLevel  string `yaml:"file_level" env:"LOG_FILE_LEVEL" reload:"true"`
+	MaxSize    int    `yaml:"max_size" env:"LOG_MAX_SIZE"`       // MiB
+	MaxBackups int    `yaml:"max_backups" env:"LOG_MAX_BACKUPS"` // 0 keeps all
+	MaxAge     int    `yaml:"max_age" env:"LOG_MAX_AGE"`         // days, 0 keeps all
+	Compress   bool   `yaml:"compress" env:"LOG_COMPRESS"`       // gzip rotated files
+
+	Syslog      string `yaml:"syslog" env:"LOG_SYSLOG"` // local, or unix, udp or tcp URL
+	SyslogLevel string `yaml:"syslog_level" env:"LOG_SYSLOG_LEVEL" reload:"true"`
+	SyslogTag   string `yaml:"syslog_tag" env:"LOG_SYSLOG_TAG"`
+}
+
+// OpenTelemetry tracing. Spans are exported to an OTLP/HTTP collector
+// or written to the standard output.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER"`            // none, otlp or stdout
+	Endpoint    string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"` // http:// or https:// URL of the collector
+	ServiceName string  `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"` // of the traces without a sampled parent
+}
+
+type DB struct {
+	Host     string `yaml:"host" env:"DB_HOST"`
+	Port     string `yaml:"port" env:"DB_PORT"`
+	User     string `yaml:"user" env:"DB_USER"`
+	Password string `yaml:"password" env:"DB_PASSWORD" secret:"true"`
+	Name     string `yaml:"name" env:"DB_NAME"`
+}
+
+type Security struct {
+	AllowedHosts          []string `yaml:"allowed_hosts" env:"ALLOWED_HOSTS"`
+	SSLRedirect           bool     `yaml:"ssl_redirect" env:"SSL_REDIRECT"`
+	SSLHost               string   `yaml:"ssl_host" env:"SSL_HOST"` // request host if empty
+	STSSeconds            int64    `yaml:"sts_seconds" env:"STS_SECONDS"`
+	ContentSecurityPolicy string   `yaml:"content_security_policy" env:"CONTENT_SECURITY_POLICY"`
+	CORSOrigins           []string `yaml:"cors_origins" env:"CORS_ORIGINS" reload:"true"`
+}
+
+// Requests per minute from one client IP.
+type RateLimit struct {
+	Login   int `yaml:"login" env:"RATE_LIMIT_LOGIN" reload:"true"` // also single sign-on
+	Refresh int `yaml:"refresh" env:"RATE_LIMIT_REFRESH" reload:"true"`
+	SignUp  int `yaml:"signup" env:"RATE_LIMIT_SIGNUP" reload:"true"`
+	Mail    int `yaml:"mail" env:"RATE_LIMIT_MAIL" reload:"true"` // password reset and verification mails
+	Verify  int `yaml:"verify" env:"RATE_LIMIT_VERIFY" reload:"true"`
+}
+
+type JWT struct {
+	Timeout        time.Duration `yaml:"timeout" env:"JWT_TIMEOUT"`
+	MaxRefresh     time.Duration `yaml:"max_refresh" env:"JWT_MAX_REFRESH"`
+	RefreshTimeout time.Duration `yaml:"refresh_timeout" env:"REFRESH_TIMEOUT"`
+	KeyDir         string        `yaml:"key_dir" env:"KEY_DIR"`
+	KeyAlgorithm   string        `yaml:"key_algorithm" env:"KEY_ALGORITHM"` // RS256, ES256 or EdDSA
+	KeyRotation    time.Duration `yaml:"key_rotation" env:"KEY_ROTATION"`   // 0 disables the rotation
+	KeyOverlap     time.Duration `yaml:"key_overlap" env:"KEY_OVERLAP"`
+}
+
+type Auth struct {
+	Providers       []string      `yaml:"providers" env:"AUTH_PROVIDERS"` // local, ldap
+	SignUpDisabled  bool          `yaml:"signup_disabled" env:"SIGNUP_DISABLED"`
+	MaxFailedLogins int           `yaml:"max_failed_logins" env:"MAX_FAILED_LOGINS"`
+	LockoutTime     time.Duration `yaml:"lockout_time" env:"LOCKOUT_TIME"`
+	ResetTimeout    time.Duration `yaml:"reset_timeout" env:"RESET_TIMEOUT"`
+	VerifyTimeout   time.Duration `yaml:"verify_timeout" env:"VERIFY_TIMEOUT"`
+}
+
+type LDAP struct {
+	URL          string `yaml:"url" env:"LDAP_URL"`
+	StartTLS     bool   `yaml:"starttls" env:"LDAP_STARTTLS"`
+	BindDN       string `yaml:"bind_dn" env:"LDAP_BIND_DN"`
+	BindPassword string `yaml:"bind_password" env:"LDAP_BIND_PASSWORD" secret:"true"`
+	BaseDN       string `yaml:"base_dn" env:"LDAP_BASE_DN"`
+	UserFilter   string `yaml:"user_filter" env:"LDAP_USER_FILTER"`
+	GroupAttr    string `yaml:"group_attr" env:"LDAP_GROUP_ATTR"`
+	GroupRoles   string `yaml:"group_roles" env:"LDAP_GROUP_ROLES"` // "group DN:role;..."
+}
+
+type OIDC struct {
+	Issuer       string `yaml:"issuer" env:"OIDC_ISSUER"` // disabled if empty
+	ClientID     string `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+}
+
+type Mail struct {
+	SMTPHost     string `yaml:"smtp_host" env:"SMTP_HOST"` // log delivery if empty
+	SMTPPort     string `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUser     string `yaml:"smtp_user" env:"SMTP_USER"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	From         string `yaml:"from" env:"SMTP_FROM"`
+	Domain       string `yaml:"domain" env:"MAIL_DOMAIN"`
+	ResetURL     string `yaml:"reset_url" env:"PASSWORD_RESET_URL"`
+	VerifyURL    string `yaml:"verify_url" env:"VERIFY_URL"`
+}
+
+type Password struct {
+	MinLength     int    `yaml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	MaxLength     int    `yaml:"max_length" env:"PASSWORD_MAX_LENGTH"` // 0 is unlimited
+	Classes       int    `yaml:"classes" env:"PASSWORD_CLASSES"`
+	ASCIIOnly     bool   `yaml:"ascii_only" env:"PASSWORD_ASCII_ONLY"`
+	Normalize     bool   `yaml:"normalize" env:"PASSWORD_NORMALIZE"`
+	MinScore      int    `yaml:"min_score" env:"PASSWORD_MIN_SCORE"`
+	BreachedFile  string `yaml:"breached_file" env:"PASSWORD_BREACHED_FILE"`
+	Hasher        string `yaml:"hasher" env:"PASSWORD_HASHER"`      // argon2id or bcrypt
+	Argon2Memory  uint32 `yaml:"argon2_memory" env:"ARGON2_MEMORY"` // KiB
+	Argon2Time    uint32 `yaml:"argon2_time" env:"ARGON2_TIME"`
+	Argon2Threads uint8  `yaml:"argon2_threads" env:"ARGON2_THREADS"`
+	BcryptCost    int    `yaml:"bcrypt_cost" env:"BCRYPT_COST"`
+}
+
+type Storage struct {
+	UploadDir    string   `yaml:"upload_dir" env:"UPLOAD_DIR"`
+	Quota        int64    `yaml:"quota" env:"USER_QUOTA" reload:"true"`              // bytes per user, 0 is unlimited
+	AllowedTypes []string `yaml:"allowed_types" env:"ALLOWED_TYPES" reload:"true"`   // "image/png" or "image/*", any if empty
+	MinFreeSpace int64    `yaml:"min_free_space" env:"MIN_FREE_SPACE" reload:"true"` // bytes, the readiness check fails below
+}
+
+// Outgoing webhooks of file events. Failed deliveries are retried with
+// an exponential backoff from backoff_base up to backoff_max.
+type Webhooks struct {
+	Timeout     time.Duration `yaml:"timeout" env:"WEBHOOK_TIMEOUT" reload:"true"`
+	MaxAttempts int           `yaml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS" reload:"true"`
+	BackoffBase time.Duration `yaml:"backoff_base" env:"WEBHOOK_BACKOFF_BASE" reload:"true"`
+	BackoffMax  time.Duration `yaml:"backoff_max" env:"WEBHOOK_BACKOFF_MAX" reload:"true"`
+	// Delivery to loopback and private addresses, for development only.
+	AllowPrivate bool `yaml:"allow_private" env:"WEBHOOK_ALLOW_PRIVATE" reload:"true"`
+}
+
+// Returns the configuration with the default settings.
+func Default() *Config {
+	return &Config{
+		Mode: "debug",
+		Server: Server{
+			Addr:               "127.0.0.1:8080",
+			TrustedProxies:     []string{"127.0.0.1"},
+			MaxMultipartMemory: 8 << 20,
+			MetricsAddr:        "127.0.0.1:9090",
+			ReadHeaderTimeout:  10 * time.Second,
+			IdleTimeout:        2 * time.Minute,
+			ShutdownTimeout:    30 * time.Second,
+		},
+		TLS: TLS{
+			ClientAuth: "none",
+		},
+		Log: Log{
+			Level:      "debug",
+			Format:     "text",
+			SyslogTag:  "spa-api",
+			File:       "logging/logs.log",
+			MaxSize:    16,
+			MaxBackups: 3,
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			Endpoint:    "http://localhost:4318",
+			ServiceName: "spa-api",
+			SampleRatio: 1,
+		},
+		DB: DB{
+			Host: "127.0.0.1",
+			Port: "5432",
+			User: "postgres",
+			Name: "spa",
+		},
+		Security: Security{
+			AllowedHosts:          []string{"127.0.0.1:8080", "ssl.example.com"},
+			STSSeconds:            315360000,
+			ContentSecurityPolicy: "default-src 'self'",
+			CORSOrigins:           []string{"https://ssl.example.com"},
+		},
+		RateLimit: RateLimit{
+			Login:   20,
+			Refresh: 20,
+			SignUp:  5,
+			Mail:    5,
+			Verify:  20,
+		},
+		JWT: JWT{
+			Timeout:        time.Hour,
+			MaxRefresh:     time.Hour,
+			RefreshTimeout: 14 * 24 * time.Hour,
+			KeyDir:         "keys",
+			KeyAlgorithm:   "RS256",
+			KeyOverlap:     24 * time.Hour,
+		},
+		Auth: Auth{
+			Providers:       []string{"local"},
+			MaxFailedLogins: 5,
+			LockoutTime:     15 * time.Minute,
+			ResetTimeout:    time.Hour,
+			VerifyTimeout:   48 * time.Hour,
+		},
+		LDAP: LDAP{
+			UserFilter: "(uid=%s)",
+			GroupAttr:  "memberOf",
+		},
+		Mail: Mail{
+			SMTPPort:  "587",
+			From:      "no-reply@example.com",
+			ResetURL:  "https://ssl.example.com/reset",
+			VerifyURL: "https://ssl.example.com/verify",
+		},
+		Password: Password{
+			MinLength:     16,
+			MaxLength:     72,
+			Classes:       4,
+			ASCIIOnly:     true,
+			Normalize:     true,
+			Hasher:        "argon2id",
+			Argon2Memory:  64 * 1024,
+			Argon2Time:    3,
+			Argon2Threads: 2,
+			BcryptCost:    10,
+		},
+		Storage: Storage{
+			UploadDir:    "upload",
+			MinFreeSpace: 100 << 20,
+		},
+		Webhooks: Webhooks{
+			Timeout:     10 * time.Second,
+			MaxAttempts: 8,
+			BackoffBase: 30 * time.Second,
+			BackoffMax:  time.Hour,
+		},
+	}
+}
+
+// Checks the settings. Returns all problems joined in one error.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	oneOf := func(value string, values ...string) bool {
+		for _, v := range values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	}
+	isURL := func(value string) bool {
+		u, err := url.Parse(value)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+	}
+
+	check(oneOf(c.Mode, "debug", "release", "test"),
+		"mode: unknown mode %q", c.Mode)
+
+	_, _, err := net.SplitHostPort(c.Server.Addr)
+	check(err == nil, "server.addr: %v", err)
+	for _, proxy := range c.Server.TrustedProxies {
+		_, _, err := net.ParseCIDR(proxy)
+		check(err == nil || net.ParseIP(proxy) != nil,
+			"server.trusted_proxies: invalid address %q", proxy)
+	}
+	if c.Server.MetricsAddr != "" {
+		_, _, err := net.SplitHostPort(c.Server.MetricsAddr)
+		check(err == nil, "server.metrics_addr: %v", err)
+	}
+	check(c.Server.MaxMultipartMemory > 0,
+		"server.max_multipart_memory: must be positive")
+	check(c.Server.ReadHeaderTimeout >= 0 &&
+		c.Server.ReadTimeout >= 0 &&
+		c.Server.WriteTimeout >= 0 &&
+		c.Server.IdleTimeout >= 0,
+		"server: timeouts must not be negative")
+	check(c.Server.ShutdownTimeout > 0,
+		"server.shutdown_timeout: must be positive")
+
+	check(c.TLS.Enabled() == (c.TLS.KeyFile != ""),
+		"tls: cert_file and key_file must be set together")
+	check(oneOf(c.TLS.ClientAuth, "none", "optional", "require"),
+		"tls.client_auth: unknown mode %q", c.TLS.ClientAuth)
+	check(c.TLS.ClientAuth == "none" || c.TLS.Enabled() && c.TLS.ClientCAFile != "",
+		"tls.client_auth: requires tls.cert_file and tls.client_ca_file")
+	check(!c.TLS.APIKeyClientCert || c.TLS.ClientAuth != "none",
+		"tls.api_key_client_cert: requires tls.client_auth")
+	if c.TLS.RedirectAddr != "" {
+		_, _, err := net.SplitHostPort(c.TLS.RedirectAddr)
+		check(err == nil, "tls.redirect_addr: %v", err)
+		check(c.TLS.Enabled(), "tls.redirect_addr: requires tls.cert_file")
+	}
+
+	_, err = logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level: %v", err)
+	for key, level := range map[string]string{
+		"console_level": c.Log.ConsoleLevel,
+		"file_level":    c.Log.FileLevel,
+		"syslog_level":  c.Log.SyslogLevel,
+	} {
+		if level != "" {
+			_, err := logrus.ParseLevel(level)
+			check(err == nil, "log.%s: %v", key, err)
+		}
+	}
+	check(oneOf(c.Log.Format, "text", "json"),
+		"log.format: unknown format %q", c.Log.Format)
+	check(c.Log.Console != "" || c.Log.File != "" || c.Log.Syslog != "",
+		"log: console, file or syslog must be set")
+	check(oneOf(c.Log.Console, "", "stdout", "stderr"),
+		"log.console: unknown console %q", c.Log.Console)
+	check(c.Log.MaxSize > 0, "log.max_size: must be positive")
+	check(c.Log.MaxBackups >= 0, "log.max_backups: must not be negative")
+	check(c.Log.MaxAge >= 0, "log.max_age: must not be negative")
+	if c.Log.Syslog != "" && c.Log.Syslog != "local" {
+		u, err := url.Parse(c.Log.Syslog)
+		check(err == nil && oneOf(u.Scheme, "unix", "unixgram", "udp", "tcp"),
+			"log.syslog: must be local or a unix, udp or tcp URL")
+	}
+
+	check(oneOf(c.Tracing.Exporter, "none", "otlp", "stdout"),
+		"tracing.exporter: unknown exporter %q", c.Tracing.Exporter)
+	check(c.Tracing.Exporter != "otlp" || isURL(c.Tracing.Endpoint),
+		"tracing.endpoint: invalid URL %q", c.Tracing.Endpoint)
+	check(c.Tracing.ServiceName != "",
+		"tracing.service_name: must not be empty")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1,
+		"tracing.sample_ratio: must be between 0 and 1")
+
+	check(c.DB.Host != "", "db.host: must not be empty")
+	_, err = strconv.ParseUint(c.DB.Port, 10, 16)
+	check(err == nil, "db.port: invalid port %q", c.DB.Port)
+	check(c.DB.Name != "", "db.name: must not be empty")
+
+	check(len(c.Security.AllowedHosts) > 0,
+		"security.allowed_hosts: must not be empty")
+	check(c.Security.STSSeconds >= 0,
+		"security.sts_seconds: must not be negative")
+	for _, origin := range c.Security.CORSOrigins {
+		check(origin == "*" || isURL(origin),
+			"security.cors_origins: invalid origin %q", origin)
+	}
+
+	check(c.JWT.Timeout > 0, "jwt.timeout: must be positive")
+	check(c.JWT.MaxRefresh >= 0, "jwt.max_refresh: must not be negative")
+	check(c.JWT.RefreshTimeout > 0, "jwt.refresh_timeout: must be positive")
+	check(c.JWT.KeyDir != "", "jwt.key_dir: must not be empty")
+	check(oneOf(c.JWT.KeyAlgorithm, "RS256", "ES256", "EdDSA"),
+		"jwt.key_algorithm: unknown algorithm %q", c.JWT.KeyAlgorithm)
+	check(c.JWT.KeyRotation >= 0, "jwt.key_rotation: must not be negative")
+	check(c.JWT.KeyRotation == 0 || c.JWT.KeyOverlap > c.JWT.Timeout,
+		"jwt.key_overlap: must be longer than jwt.timeout")
+
+	check(c.RateLimit.Login > 0, "rate_limit.login: must be positive")
+	check(c.RateLimit.Refresh > 0, "rate_limit.refresh: must be positive")
+	check(c.RateLimit.SignUp > 0, "rate_limit.signup: must be positive")
+	check(c.RateLimit.Mail > 0, "rate_limit.mail: must be positive")
+	check(c.RateLimit.Verify > 0, "rate_limit.verify: must be positive")
+
+	ldap := false
+	for _, name := range c.Auth.Providers {
+		check(oneOf(name, "local", "ldap"),
+			"auth.providers: unknown provider %q", name)
+		ldap = ldap || name == "ldap"
+	}
+	check(c.Auth.MaxFailedLogins > 0, "auth.max_failed_logins: must be positive")
+	check(c.Auth.LockoutTime > 0, "auth.lockout_time: must be positive")
+	check(c.Auth.ResetTimeout > 0, "auth.reset_timeout: must be positive")
+	check(c.Auth.VerifyTimeout > 0, "auth.verify_timeout: must be positive")
+
+	if ldap {
+		u, err := url.Parse(c.LDAP.URL)
+		check(err == nil && oneOf(u.Scheme, "ldap", "ldaps"),
+			"ldap.url: invalid URL %q", c.LDAP.URL)
+		check(strings.Contains(c.LDAP.UserFilter, "%s"),
+			"ldap.user_filter: must contain %%s")
+		for _, pair := range strings.Split(c.LDAP.GroupRoles, ";") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			i := strings.LastIndex(pair, ":")
+			if i <= 0 {
+				check(false, "ldap.group_roles: invalid pair %q", pair)
+				continue
+			}
+			role := strings.TrimSpace(pair[i+1:])
+			check(oneOf(role, "admin", "user", "read-only"),
+				"ldap.group_roles: unknown role %q", role)
+		}
+	}
+
+	if c.OIDC.Issuer != "" {
+		check(isURL(c.OIDC.Issuer), "oidc.issuer: invalid URL %q", c.OIDC.Issuer)
+		check(c.OIDC.ClientID != "", "oidc.client_id: required by oidc.issuer")
+		check(isURL(c.OIDC.RedirectURL),
+			"oidc.redirect_url: invalid URL %q", c.OIDC.RedirectURL)
+	}
+
+	if c.Mail.SMTPHost != "" {
+		_, err = strconv.ParseUint(c.Mail.SMTPPort, 10, 16)
+		check(err == nil, "mail.smtp_port: invalid port %q", c.Mail.SMTPPort)
+		check(c.Mail.From != "", "mail.from: required by mail.smtp_host")
+	}
+	check(isURL(c.Mail.ResetURL), "mail.reset_url: invalid URL %q", c.Mail.ResetURL)
+	check(isURL(c.Mail.VerifyURL), "mail.verify_url: invalid URL %q", c.Mail.VerifyURL)
+
+	p := c.Password
+	check(p.MinLength >= 0, "password.min_length: must not be negative")
+	check(p.MaxLength == 0 || p.MaxLength >= p.MinLength,
+		"password.max_length: must be 0 or at least password.min_length")
+	check(p.Classes >= 0 && p.Classes <= 4,
+		"password.classes: must be from 0 to 4")
+	check(p.MinScore >= 0 && p.MinScore <= 4,
+		"password.min_score: must be from 0 to 4")
+	check(oneOf(p.Hasher, "argon2id", "bcrypt"),
+		"password.hasher: unknown algorithm %q", p.Hasher)
+	check(p.Argon2Time > 0, "password.argon2_time: must be positive")
+	check(p.Argon2Threads > 0, "password.argon2_threads: must be positive")
+	check(p.Argon2Memory >= 8*uint32(p.Argon2Threads),
+		"password.argon2_memory: must be at least 8 KiB per thread")
+	check(p.BcryptCost >= 4 && p.BcryptCost <= 31,
+		"password.bcrypt_cost: must be from 4 to 31")
+
+	check(c.Storage.UploadDir != "", "storage.upload_dir: must not be empty")
+	check(c.Storage.Quota >= 0, "storage.quota: must not be negative")
+	check(c.Storage.MinFreeSpace >= 0,
+		"storage.min_free_space: must not be negative")
+	for _, t := range c.Storage.AllowedTypes {
+		_, _, err := mime.ParseMediaType(t)
+		check(err == nil && strings.Contains(t, "/"),
+			"storage.allowed_types: invalid media type %q", t)
+	}
+
+	check(c.Webhooks.Timeout > 0, "webhooks.timeout: must be positive")
+	check(c.Webhooks.MaxAttempts > 0,
+		"webhooks.max_attempts: must be positive")
+	check(c.Webhooks.BackoffBase > 0,
+		"webhooks.backoff_base: must be positive")
+	check(c.Webhooks.BackoffMax >= c.Webhooks.BackoffBase,
+		"webhooks.backoff_max: must not be less than backoff_base")
+
+	return errors.Join(errs...)
+}
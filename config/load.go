@@ -0,0 +1,297 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file of the working directory, used if the -config flag
+// and CONFIG_FILE are empty.
+const DefaultFile = "config.yaml"
+
+// Current configuration. Packages read it during initialization without
+// the command line flags, main() sets the complete one by Set() and the
+// watcher replaces it by Reload().
+var current atomic.Pointer[Config]
+
+var hooks []func(*Config)
+
+func init() {
+	current.Store(initial())
+}
+
+// Returns the current configuration. It is not modified, a reload
+// replaces it, so the settings of one request are read from one
+// configuration.
+func Get() *Config {
+	return current.Load()
+}
+
+// Invalid settings are reported by main(), which loads the
+// configuration again with the flags.
+func initial() *Config {
+	c, err := Load(nil)
+	if err != nil {
+		return Default()
+	}
+	return c
+}
+
+// Calls the function with the current configuration and again with
+// every configuration set later. Packages copy their settings with it.
+func OnLoad(f func(*Config)) {
+	hooks = append(hooks, f)
+	f(Get())
+}
+
+// Replaces the current configuration.
+func Set(c *Config) {
+	current.Store(c)
+	for _, f := range hooks {
+		f(c)
+	}
+}
+
+// Loads the configuration from the defaults, the YAML file, the
+// environment variables and the command line flags, each overriding
+// the previous ones. Empty environment variables are ignored.
+func Load(args []string) (*Config, error) {
+	c := Default()
+	fields := walk(reflect.ValueOf(c).Elem(), "")
+
+	flags := flag.NewFlagSet("spa-api", flag.ContinueOnError)
+	path := flags.String(
+		"config",
+		os.Getenv("CONFIG_FILE"),
+		"configuration file (env CONFIG_FILE, default "+DefaultFile+")",
+	)
+	var values []func()
+	for _, f := range fields {
+		flags.Var(&flagValue{field: f, values: &values}, f.path, "env "+f.env)
+	}
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, "Usage: spa-api [dump] [flags]")
+			flags.SetOutput(os.Stderr)
+			flags.PrintDefaults()
+		}
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	file, err := readFile(c, *path)
+	if err != nil {
+		return nil, err
+	}
+	c.file = file
+	for _, f := range fields {
+		value := os.Getenv(f.env)
+		if value == "" {
+			continue
+		}
+		if err := parse(f.value, value); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.env, err)
+		}
+	}
+	for _, set := range values {
+		set()
+	}
+	return c, c.Validate()
+}
+
+// Decodes the file over the configuration and returns its path, empty
+// if there is no file. Unknown keys are errors, so misspelled settings
+// are not ignored.
+func readFile(c *Config, path string) (string, error) {
+	if path == "" {
+		if _, err := os.Stat(DefaultFile); err != nil {
+			return "", nil
+		}
+		path = DefaultFile
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	return path, nil
+}
+
+// Returns the path of the loaded configuration file, empty if the
+// settings come from the defaults and the environment only.
+func (c *Config) File() string {
+	return c.file
+}
+
+// Writes the configuration as YAML with masked secrets.
+func Dump(w io.Writer, c *Config) error {
+	root, err := node(reflect.ValueOf(c).Elem())
+	if err != nil {
+		return err
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func node(v reflect.Value) (*yaml.Node, error) {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: sf.Tag.Get("yaml")}
+		value := &yaml.Node{}
+		var err error
+		switch {
+		case sf.Type.Kind() == reflect.Struct:
+			value, err = node(v.Field(i))
+		case sf.Tag.Get("secret") == "true" && !v.Field(i).IsZero():
+			err = value.Encode("********")
+		case sf.Type == durationType:
+			err = value.Encode(time.Duration(v.Field(i).Int()).String())
+		default:
+			err = value.Encode(v.Field(i).Interface())
+		}
+		if err != nil {
+			return nil, err
+		}
+		mapping.Content = append(mapping.Content, key, value)
+	}
+	return mapping, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Setting of the configuration struct.
+type field struct {
+	path   string // YAML keys joined by dots
+	env    string
+	secret bool
+	reload bool
+	value  reflect.Value
+}
+
+func walk(v reflect.Value, prefix string) []field {
+	var fields []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		path := prefix + sf.Tag.Get("yaml")
+		if sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, walk(v.Field(i), path+".")...)
+			continue
+		}
+		fields = append(fields, field{
+			path:   path,
+			env:    sf.Tag.Get("env"),
+			secret: sf.Tag.Get("secret") == "true",
+			reload: sf.Tag.Get("reload") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+// Sets the value from the text of an environment variable or a flag.
+// Lists are comma-separated.
+func parse(v reflect.Value, text string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Uint8, reflect.Uint32:
+		n, err := strconv.ParseUint(text, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("unsupported type " + v.Type().String())
+	}
+	return nil
+}
+
+// Command line flag of a setting. The value is checked when the flag is
+// parsed and set after the file and the environment variables.
+type flagValue struct {
+	field  field
+	values *[]func()
+}
+
+func (f *flagValue) String() string {
+	return ""
+}
+
+func (f *flagValue) Set(text string) error {
+	value := reflect.New(f.field.value.Type()).Elem()
+	if err := parse(value, text); err != nil {
+		return err
+	}
+	*f.values = append(*f.values, func() { f.field.value.Set(value) })
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.field.value.Kind() == reflect.Bool
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Difference of a setting between the current and the reloaded
+// configuration.
+type Change struct {
+	Key     string
+	Old     interface{}
+	New     interface{}
+	Applied bool // false if the setting requires a restart
+}
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func(*Config)
+)
+
+// Calls the function after every reload that changed a setting.
+func OnReload(f func(*Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, f)
+}
+
+// Loads the configuration again with the same flags and replaces the
+// current one with a copy that has the changed reloadable settings.
+// Other changes are returned, but not applied. An invalid configuration
+// is an error and changes nothing.
+func Reload(args []string) ([]Change, error) {
+	loaded, err := Load(args)
+	if err != nil {
+		return nil, err
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	old := Get()
+	merged := *old
+	oldFields := walk(reflect.ValueOf(old).Elem(), "")
+	mergedFields := walk(reflect.ValueOf(&merged).Elem(), "")
+	var changes []Change
+	applied := false
+	for i, f := range walk(reflect.ValueOf(loaded).Elem(), "") {
+		before := oldFields[i].value.Interface()
+		if reflect.DeepEqual(before, f.value.Interface()) {
+			continue
+		}
+		changes = append(changes, Change{
+			Key:     f.path,
+			Old:     display(oldFields[i]),
+			New:     display(f),
+			Applied: f.reload,
+		})
+		if f.reload {
+			mergedFields[i].value.Set(f.value)
+			applied = true
+		}
+	}
+	if applied {
+		current.Store(&merged)
+		for _, f := range reloadHooks {
+			f(&merged)
+		}
+	}
+	return changes, nil
+}
+
+// Returns the value of the setting for the log.
+func display(f field) interface{} {
+	switch {
+	case f.secret && !f.value.IsZero():
+		return "********"
+	case f.value.Type() == durationType:
+		return time.Duration(f.value.Int()).String()
+	}
+	return f.value.Interface()
+}
+
+// Polls the file and calls the function after every modification until
+// the stop channel is closed. Editors often replace the file, so the
+// modification time and the size are compared instead of watching the
+// inode.
+func Watch(path string, interval time.Duration, stop <-chan struct{}, changed func()) {
+	if path == "" {
+		return
+	}
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	modified, size := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m, s := stat()
+			if m.Equal(modified) && s == size {
+				continue
+			}
+			modified, size = m, s
+			// A deleted file is not reloaded, the settings stay until it
+			// is written again.
+			if s >= 0 {
+				changed()
+			}
+		}
+	}
+}
@@ -2,11 +2,10 @@ package database
 
 import (
 	"fmt"
-	"os"
+	"spa-api/config"
 	"spa-api/logging"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/joho/godotenv/autoload"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -15,11 +14,12 @@ var C *gorm.DB
 var log = logging.Config
 
 func Connect() {
-	host := os.Getenv("DB_HOST")
-	user := os.Getenv("DB_USER")
-	pass := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	port := os.Getenv("DB_PORT")
+	settings := config.Get().DB
+	host := settings.Host
+	user := settings.User
+	pass := settings.Password
+	dbName := settings.Name
+	port := settings.Port
 	if gin.Mode() == gin.TestMode {
 		dbName = "test"
 	}
@@ -36,3 +36,14 @@ func Connect() {
 		log.Fatal(logging.F()+"() failed to initialize database:", err)
 	}
 }
+
+// Closes the connection pool.
+func Close() {
+	pool, err := C.DB()
+	if err == nil {
+		err = pool.Close()
+	}
+	if err != nil {
+		log.Error(logging.F()+"() cannot close database:", err)
+	}
+}
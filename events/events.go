@@ -0,0 +1,145 @@
+package events
+
+import (
+	"spa-api/models"
+	"sync"
+)
+
+// Types of file events.
+const (
+	FileCreated = "file.created"
+	FileRenamed = "file.renamed"
+	FileDeleted = "file.deleted"
+)
+
+// Change of a file of the user.
+type Event struct {
+	Type   string
+	UserID uint
+	File   models.File
+}
+
+// Events buffered per subscriber. A subscriber that does not keep up is
+// dropped, so its client reconnects and fetches the file list again
+// instead of missing changes silently.
+const buffer = 64
+
+// In-memory publisher of file events to the subscribers of the user.
+type Bus struct {
+	mu       sync.Mutex
+	subs     map[uint]map[chan Event]struct{}
+	handlers []*func(Event)
+	closed   bool
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: map[uint]map[chan Event]struct{}{}}
+}
+
+// Bus of the service, fed by the file handlers.
+var Default = NewBus()
+
+// Returns the channel of the events of the user and the function that
+// cancels the subscription. The channel is closed when the subscription
+// is cancelled or dropped, or the bus is closed.
+func (b *Bus) Subscribe(userID uint) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subs[userID] == nil {
+		b.subs[userID] = map[chan Event]struct{}{}
+	}
+	b.subs[userID][ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.drop(userID, ch)
+	}
+}
+
+// Calls the function with the events of all users until the returned
+// function removes it. Handlers run in the goroutine of Publish, so
+// they must not block for long.
+func (b *Bus) Handle(f func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	handler := &f
+	b.handlers = append(b.handlers, handler)
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// A new slice, Publish may be iterating over the current one.
+		handlers := make([]*func(Event), 0, len(b.handlers))
+		for _, h := range b.handlers {
+			if h != handler {
+				handlers = append(handlers, h)
+			}
+		}
+		b.handlers = handlers
+	}
+}
+
+// Sends the event to the subscribers of its user without blocking and
+// calls the handlers.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	for ch := range b.subs[e.UserID] {
+		select {
+		case ch <- e:
+		default:
+			b.drop(e.UserID, ch)
+		}
+	}
+	handlers := b.handlers
+	b.mu.Unlock()
+	for _, f := range handlers {
+		(*f)(e)
+	}
+}
+
+// Closes all subscriptions, so the streams end before the server shuts
+// down.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for userID, subs := range b.subs {
+		for ch := range subs {
+			close(ch)
+		}
+		delete(b.subs, userID)
+	}
+	b.closed = true
+}
+
+// Removes and closes the subscription if it still exists. The caller
+// holds the lock.
+func (b *Bus) drop(userID uint, ch chan Event) {
+	if _, ok := b.subs[userID][ch]; !ok {
+		return
+	}
+	close(ch)
+	delete(b.subs[userID], ch)
+	if len(b.subs[userID]) == 0 {
+		delete(b.subs, userID)
+	}
+}
+
+func Subscribe(userID uint) (<-chan Event, func()) {
+	return Default.Subscribe(userID)
+}
+
+func Handle(f func(Event)) func() {
+	return Default.Handle(f)
+}
+
+func Publish(e Event) {
+	Default.Publish(e)
+}
+
+func Close() {
+	Default.Close()
+}
@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"spa-api/notify"
+	"strings"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Delivery of password reset and mail verification links.
+var Mailer notify.Notifier
+
+// Mail domain of users whose username is not an address.
+var MailDomain string
+
+// Page of the frontend that receives the reset token.
+var ResetURL string
+
+// Page of the frontend that receives the verification token.
+var VerifyURL string
+
+// Lifetimes of password reset and mail verification tokens.
+var (
+	ResetTimeout  time.Duration
+	VerifyTimeout time.Duration
+)
+
+// Returns the mail address of the user, empty if it is unknown.
+func address(user *models.User) string {
+	if user.Email != "" && user.EmailVerified {
+		return user.Email
+	}
+	if strings.Contains(user.Username, "@") {
+		return user.Username
+	}
+	if MailDomain != "" {
+		return user.Username + "@" + MailDomain
+	}
+	return ""
+}
+
+// Reports whether the user has a mail address that is not verified
+// yet. Users without an address need no verification.
+func unverified(user *models.User) bool {
+	return user.Email != "" && !user.EmailVerified
+}
+
+// Creates a single-use token of the kind for the user. Previous tokens
+// of the same kind are deleted, so only the last sent link is valid.
+func newUserToken(
+	tx *gorm.DB,
+	userID uint,
+	kind string,
+	timeout time.Duration,
+) (string, error) {
+	token, err := randomID(32)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Unscoped().
+		Where("user_id = ? AND kind = ?", userID, kind).
+		Delete(&models.UserToken{}).Error
+	if err != nil {
+		return "", err
+	}
+	err = tx.Create(&models.UserToken{
+		UserID:    userID,
+		Kind:      kind,
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(timeout),
+	}).Error
+	return token, err
+}
+
+// Finds and deletes the valid token of the kind. Must be called in a
+// transaction with the action the token confirms.
+func useUserToken(tx *gorm.DB, token, kind string) (*models.UserToken, error) {
+	var entry models.UserToken
+	dbReq := tx.
+		Where("hash = ? AND kind = ?", hashToken(token), kind).
+		Where("expires_at > ?", time.Now()).
+		First(&entry)
+	if dbReq.Error != nil {
+		return nil, dbReq.Error
+	}
+	// The row count prevents concurrent reuse of the token.
+	dbReq = tx.Unscoped().Delete(&entry)
+	if dbReq.Error != nil {
+		return nil, dbReq.Error
+	}
+	if dbReq.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &entry, nil
+}
+
+// Sends the mail address verification link to the user.
+func sendVerification(user *models.User) error {
+	token, err := newUserToken(db.C, user.ID, models.TokenVerify, VerifyTimeout)
+	if err != nil {
+		return err
+	}
+	return Mailer.Send(
+		user.Email,
+		"Verify your mail address",
+		"Follow the link to verify your mail address:\r\n\r\n"+
+			VerifyURL+"?token="+token+"\r\n\r\n"+
+			"The link is valid for "+VerifyTimeout.String()+".\r\n",
+	)
+}
+
+// Revokes all sessions and refresh tokens of the user except the
+// specified session.
+func revokeOtherSessions(tx *gorm.DB, userID, sessionID uint) error {
+	err := tx.Model(&models.Session{}).
+		Where("user_id = ? AND id <> ?", userID, sessionID).
+		Update("revoked", true).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND session_id <> ?", userID, sessionID).
+		Update("revoked", true).Error
+}
+
+// Changes the password of a local user after the check of the current
+// one. Other sessions of the user are revoked. Return a message about
+// the result of data processing.
+func ChangePassword(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	sid, _ := claims["sid"].(float64)
+	var vals struct {
+		Password    string
+		NewPassword string
+	}
+	if err := c.ShouldBind(&vals); err != nil {
+		log.Error(logging.F()+"() parsing error:", err)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Failed to change password. Fields missing."},
+		)
+		return
+	}
+	var user models.User
+	if err := db.C.First(&user, userID).Error; err != nil {
+		log.Error(logging.F()+"() cannot find user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	if user.Provider != models.ProviderLocal {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Password is managed by your company account."},
+		)
+		return
+	}
+	if !verifyPassword(user.Password, vals.Password) {
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{"message": "Current password is incorrect."},
+		)
+		return
+	}
+	err := checkPass(vals.NewPassword, user.Username, user.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	hashedPass, err := hashPassword(vals.NewPassword)
+	if err != nil {
+		log.Error(logging.F()+"() hashing error:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to change password."},
+		)
+		return
+	}
+	err = db.C.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Update("password", hashedPass).Error
+		if err != nil {
+			return err
+		}
+		return revokeOtherSessions(tx, userID, uint(sid))
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot change password:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to change password."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed."})
+}
+
+// Sends a password reset link to the local user. The response is the
+// same whether the user exists or not, failures to send are only
+// logged.
+func RequestReset(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	var vals struct{ Username string }
+	if err := c.ShouldBind(&vals); err != nil || vals.Username == "" {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Fields cannot be empty."},
+		)
+		return
+	}
+	response := gin.H{
+		"message": "If the account exists, a reset link has been sent.",
+	}
+	var user models.User
+	dbReq := db.C.Where("username = ?", vals.Username).First(&user)
+	if dbReq.Error != nil ||
+		user.Provider != models.ProviderLocal ||
+		user.Disabled {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	to := address(&user)
+	if to == "" {
+		log.WithFields(logrus.Fields{
+			"ID": user.ID,
+		}).Warn(logging.F() + "() no mail address for reset:")
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	var token string
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		var err error
+		token, err = newUserToken(tx, user.ID, models.TokenReset, ResetTimeout)
+		return err
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot save reset token:", err)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	err = Mailer.Send(
+		to,
+		"Password reset",
+		"Follow the link to set a new password:\r\n\r\n"+
+			ResetURL+"?token="+token+"\r\n\r\n"+
+			"The link is valid for "+ResetTimeout.String()+". "+
+			"Ignore this message if you did not request the reset.\r\n",
+	)
+	if err != nil {
+		log.Error(logging.F()+"() cannot send reset link:", err)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Sets a new password by the reset token. The token is used once, all
+// sessions and tokens of the user are revoked and the lockout is
+// cleared.
+func ResetPassword(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	var vals struct {
+		Token    string
+		Password string
+	}
+	if err := c.ShouldBind(&vals); err != nil || vals.Token == "" {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Fields cannot be empty."},
+		)
+		return
+	}
+	// The password is checked against the user of the token, and a
+	// rejected password rolls back the use of the token.
+	var weak, hashErr error
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		entry, err := useUserToken(tx, vals.Token, models.TokenReset)
+		if err != nil {
+			return err
+		}
+		var user models.User
+		if err := tx.First(&user, entry.UserID).Error; err != nil {
+			return err
+		}
+		if weak = checkPass(vals.Password, user.Username, user.Email); weak != nil {
+			return weak
+		}
+		hashedPass, err := hashPassword(vals.Password)
+		if err != nil {
+			hashErr = err
+			return err
+		}
+		err = tx.Model(&user).
+			Updates(map[string]interface{}{
+				"password":           hashedPass,
+				"failed_logins":      0,
+				"locked_until":       time.Time{},
+				"tokens_valid_after": time.Now(),
+			}).Error
+		if err != nil {
+			return err
+		}
+		return revokeOtherSessions(tx, user.ID, 0)
+	})
+	if weak != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": weak.Error()})
+		return
+	}
+	if hashErr != nil {
+		log.Error(logging.F()+"() hashing error:", hashErr)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to reset password."},
+		)
+		return
+	}
+	if err != nil {
+		log.Error(logging.F()+"() cannot reset password:", err)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Reset link is invalid or expired."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed."})
+}
+
+// Marks the mail address of the user as verified by the token from the
+// verification link.
+func VerifyEmail(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	var vals struct{ Token string }
+	if err := c.ShouldBind(&vals); err != nil || vals.Token == "" {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Fields cannot be empty."},
+		)
+		return
+	}
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		entry, err := useUserToken(tx, vals.Token, models.TokenVerify)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", entry.UserID).
+			Update("email_verified", true).Error
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot verify address:", err)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Verification link is invalid or expired. Request a new one."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Mail address verified."})
+}
+
+// Sends a new verification link to the user. The previous link stops
+// working.
+func ResendVerification(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var user models.User
+	if err := db.C.First(&user, userID).Error; err != nil {
+		log.Error(logging.F()+"() cannot find user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	if !unverified(&user) {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "There is no mail address to verify."},
+		)
+		return
+	}
+	if err := sendVerification(&user); err != nil {
+		log.Error(logging.F()+"() cannot send verification link:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to send a verification link."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Verification link sent."})
+}
+
+// Deletes the account of the user with all files and database entries.
+// Local users confirm the deletion with the password.
+func DeleteAccount(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var vals struct{ Password string }
+	c.ShouldBind(&vals)
+	var user models.User
+	if err := db.C.First(&user, userID).Error; err != nil {
+		log.Error(logging.F()+"() cannot find user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	if user.Provider == models.ProviderLocal &&
+		!verifyPassword(user.Password, vals.Password) {
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{"message": "Password is incorrect."},
+		)
+		return
+	}
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		// Deliveries belong to the user through the webhooks.
+		hooks := tx.Model(&models.Webhook{}).Select("id").
+			Where("user_id = ?", userID)
+		dbReq := tx.Where("webhook_id IN (?)", hooks).
+			Delete(&models.WebhookDelivery{})
+		if dbReq.Error != nil {
+			return dbReq.Error
+		}
+		for _, table := range models.Tables() {
+			if _, ok := table.(*models.User); ok {
+				continue
+			}
+			if !tx.Migrator().HasColumn(table, "UserID") {
+				continue
+			}
+			dbReq := tx.Unscoped().Where("user_id = ?", userID).Delete(table)
+			if dbReq.Error != nil {
+				return dbReq.Error
+			}
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot delete account:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to delete account."},
+		)
+		return
+	}
+	// Entries are deleted first, so a file removal error does not leave
+	// an account without files.
+	if err := os.RemoveAll(userDir(userID)); err != nil {
+		log.Error(logging.F()+"() removing error:", err)
+	}
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Info(logging.F() + "() account deleted:")
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted."})
+}
@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"spa-api/config"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var ErrAccountDisabled = errors.New("account is disabled")
+
+// Returns the effective storage quota of the user, zero if unlimited.
+// Users without a personal quota have the quota of the current
+// configuration.
+func quotaOf(user *models.User) int64 {
+	if user.Quota > 0 {
+		return user.Quota
+	}
+	return config.Get().Storage.Quota
+}
+
+// Returns the number of files of the user and their total size.
+func usage(userID uint) (int64, int64, error) {
+	var result struct {
+		Files int64
+		Size  int64
+	}
+	dbReq := db.C.Model(&models.File{}).
+		Select("count(*) AS files, coalesce(sum(size), 0) AS size").
+		Where("user_id = ?", userID).
+		Scan(&result)
+	return result.Files, result.Size, dbReq.Error
+}
+
+func userInfo(user *models.User) (gin.H, error) {
+	files, size, err := usage(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"ID":        user.ID,
+		"Username":  user.Username,
+		"Email":     user.Email,
+		"Verified":  !unverified(user),
+		"Provider":  user.Provider,
+		"Role":      user.Role,
+		"Disabled":  user.Disabled,
+		"Quota":     quotaOf(user),
+		"Files":     files,
+		"Usage":     size,
+		"CreatedAt": user.CreatedAt,
+	}, nil
+}
+
+// Return a list of all users with their storage usage.
+func AdminUsers(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	var users []models.User
+	dbReq := db.C.Order("id").Find(&users)
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot find users:", dbReq.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Can't find users."})
+		return
+	}
+	list := make([]gin.H, 0, len(users))
+	for i := range users {
+		info, err := userInfo(&users[i])
+		if err != nil {
+			log.Error(logging.F()+"() cannot count usage:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Can't count usage."})
+			return
+		}
+		list = append(list, info)
+	}
+	c.JSON(http.StatusOK, gin.H{"users": list})
+}
+
+// Return the storage usage of the user specified by the "id" query.
+func AdminUsage(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	var user models.User
+	dbReq := db.C.First(&user, "id = ?", c.Query("id"))
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot find user:", dbReq.Error)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	info, err := userInfo(&user)
+	if err != nil {
+		log.Error(logging.F()+"() cannot count usage:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Can't count usage."})
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// Binds the admin request values. Admins cannot change their own
+// account, so they cannot lock themselves out.
+func adminVals(c *gin.Context, vals *models.User) bool {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	adminID := uint(claims["id"].(float64))
+	if err := c.ShouldBind(vals); err != nil || vals.ID == 0 {
+		log.WithFields(logrus.Fields{
+			"ID": vals.ID,
+		}).Error(logging.F()+"() parsing error:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "User ID is missing."})
+		return false
+	}
+	if vals.ID == adminID {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "You cannot change your own account."},
+		)
+		return false
+	}
+	log.WithFields(logrus.Fields{
+		"admin": adminID,
+		"ID":    vals.ID,
+	}).Info(logging.F() + "() admin operation:")
+	return true
+}
+
+func updateUser(c *gin.Context, userID uint, values map[string]interface{}) {
+	log := logging.Ctx(c.Request.Context())
+	dbReq := db.C.Model(&models.User{}).Where("id = ?", userID).Updates(values)
+	if dbReq.Error != nil || dbReq.RowsAffected == 0 {
+		log.Error(logging.F()+"() cannot update user:", dbReq.Error)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// Updates the user like updateUser() and revokes all its sessions,
+// access and refresh tokens in the same transaction, so the change
+// applies at once instead of when the tokens expire.
+func updateAndRevoke(c *gin.Context, userID uint, values map[string]interface{}) {
+	log := logging.Ctx(c.Request.Context())
+	values["tokens_valid_after"] = time.Now()
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		dbReq := tx.Model(&models.User{}).Where("id = ?", userID).
+			Updates(values)
+		if dbReq.Error != nil {
+			return dbReq.Error
+		}
+		if dbReq.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		err := tx.Model(&models.Session{}).
+			Where("user_id = ?", userID).
+			Update("revoked", true).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).
+			Where("user_id = ?", userID).
+			Update("revoked", true).Error
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot update user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// Disables the specified account and revokes all its sessions and
+// tokens. API keys are kept but rejected while the account is
+// disabled.
+func DisableUser(c *gin.Context) {
+	var vals models.User
+	if !adminVals(c, &vals) {
+		return
+	}
+	updateAndRevoke(c, vals.ID, map[string]interface{}{"disabled": true})
+}
+
+// Enables the specified account.
+func EnableUser(c *gin.Context) {
+	var vals models.User
+	if !adminVals(c, &vals) {
+		return
+	}
+	updateUser(c, vals.ID, map[string]interface{}{"disabled": false})
+}
+
+// Changes the role of the specified user. Sessions and tokens with the
+// old role claim are revoked, API keys get the new role at once.
+func SetRole(c *gin.Context) {
+	var vals models.User
+	if !adminVals(c, &vals) {
+		return
+	}
+	switch vals.Role {
+	case models.RoleAdmin, models.RoleUser, models.RoleReadOnly:
+	default:
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Role must be admin, user or read-only."},
+		)
+		return
+	}
+	updateAndRevoke(c, vals.ID, map[string]interface{}{"role": vals.Role})
+}
+
+// Sets a personal storage quota in bytes for the specified user.
+func SetQuota(c *gin.Context) {
+	var vals models.User
+	if !adminVals(c, &vals) {
+		return
+	}
+	if vals.Quota <= 0 {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Quota must be a positive number of bytes."},
+		)
+		return
+	}
+	updateUser(c, vals.ID, map[string]interface{}{"quota": vals.Quota})
+}
+
+// Resets the quota of the specified user to the default quota.
+func ResetQuota(c *gin.Context) {
+	var vals models.User
+	if !adminVals(c, &vals) {
+		return
+	}
+	updateUser(c, vals.ID, map[string]interface{}{"quota": 0})
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"net/http"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"strings"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Prefix of personal API keys. It separates keys from webtokens in the
+// Authorization header.
+const APIKeyPrefix = "wsk_"
+
+// Returns the stored API key for the raw key from the Authorization
+// header.
+func FindAPIKey(key string) (*models.APIKey, error) {
+	var entry models.APIKey
+	dbReq := db.C.Where("hash = ?", hashToken(key)).First(&entry)
+	if dbReq.Error != nil {
+		return nil, dbReq.Error
+	}
+	return &entry, nil
+}
+
+// Checks that the API key is not revoked and its user is not disabled.
+func CheckAPIKey(key *models.APIKey) error {
+	if err := db.C.Select("id").First(&models.APIKey{}, key.ID).Error; err != nil {
+		return err
+	}
+	var user models.User
+	if err := db.C.Select("id", "disabled").First(&user, key.UserID).Error; err != nil {
+		return err
+	}
+	if user.Disabled {
+		return ErrAccountDisabled
+	}
+	return nil
+}
+
+// Saves the last usage time of the API key.
+func TouchAPIKey(key *models.APIKey) {
+	dbReq := db.C.Model(key).Update("last_used", time.Now())
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot save key usage:", dbReq.Error)
+	}
+}
+
+// Return a list of API keys of the user without the keys themselves.
+func APIKeys(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var keys []models.APIKey
+	dbReq := db.C.Where("user_id = ?", userID).Order("id").Find(&keys)
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot find keys:", dbReq.Error)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	list := make([]gin.H, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, gin.H{
+			"ID":        k.ID,
+			"Name":      k.Name,
+			"Prefix":    k.Prefix,
+			"Scope":     k.Scope,
+			"CreatedAt": k.CreatedAt,
+			"LastUsed":  k.LastUsed,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": list})
+}
+
+// Creates a new API key with the specified name and scope. Return the
+// key, it is shown only once.
+func CreateAPIKey(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var vals models.APIKey
+	if err := c.ShouldBind(&vals); err != nil {
+		log.WithFields(logrus.Fields{
+			"Name":  vals.Name,
+			"Scope": vals.Scope,
+		}).Error(logging.F()+"() parsing error:", err)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Failed to create a key. Fields missing."},
+		)
+		return
+	}
+	name := strings.TrimSpace(vals.Name)
+	switch vals.Scope {
+	case models.ScopeRead, models.ScopeUpload, models.ScopeFull:
+	default:
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Scope must be read, upload or full."},
+		)
+		return
+	}
+	if name == "" {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Fields cannot be empty."},
+		)
+		return
+	}
+	random, err := randomID(32)
+	if err != nil {
+		log.Error(logging.F()+"() key generation error:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to create a key."},
+		)
+		return
+	}
+	key := APIKeyPrefix + random
+	entry := models.APIKey{
+		UserID: userID,
+		Name:   name,
+		Prefix: key[:len(APIKeyPrefix)+8],
+		Hash:   hashToken(key),
+		Scope:  vals.Scope,
+	}
+	if err := db.C.Create(&entry).Error; err != nil {
+		log.Error(logging.F()+"() cannot save key:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to create a key."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ID":    entry.ID,
+		"key":   key,
+		"Scope": entry.Scope,
+	})
+}
+
+// Deletes the specified API key of the user. Return a message about
+// the result of data processing.
+func RevokeAPIKey(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var vals models.APIKey
+	if err := c.ShouldBind(&vals); err != nil {
+		log.WithFields(logrus.Fields{
+			"ID": vals.ID,
+		}).Error(logging.F()+"() parsing error:", err)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Cannot revoke a key."},
+		)
+		return
+	}
+	dbReq := db.C.Unscoped().
+		Where("id = ? AND user_id = ?", vals.ID, userID).
+		Delete(&models.APIKey{})
+	if dbReq.Error != nil || dbReq.RowsAffected == 0 {
+		log.Error(logging.F()+"() cannot find key:", dbReq.Error)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find a key."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Maximal number of events of an activity page.
+const maxActivity = 200
+
+// Records the action of the request in the audit log. The client
+// address, user agent and request ID are taken from the request, the
+// actor name from the database if it is not set. A failure to record
+// is logged and does not fail the action.
+func audit(c *gin.Context, event models.AuditEvent) {
+	log := logging.Ctx(c.Request.Context())
+	tx := db.C.WithContext(c.Request.Context())
+	if event.Actor == "" && event.ActorID != 0 {
+		var user models.User
+		if err := tx.Select("username").First(&user, event.ActorID).Error; err == nil {
+			event.Actor = user.Username
+		}
+	}
+	event.IP = c.ClientIP()
+	event.UserAgent = c.Request.UserAgent()
+	event.RequestID = logging.RequestID(c.Request.Context())
+	if err := tx.Create(&event).Error; err != nil {
+		log.WithFields(logrus.Fields{
+			"action": event.Action,
+			"actor":  event.ActorID,
+		}).Error(logging.F()+"() cannot record audit event:", err)
+	}
+}
+
+// Returns the outcome and the failure detail of the error.
+func outcome(err error) (string, string) {
+	if err != nil {
+		return models.OutcomeFailure, err.Error()
+	}
+	return models.OutcomeSuccess, ""
+}
+
+// Return the audit events of the user, newest first. The "limit" query
+// is the page size and the "before" query is the ID of the last event
+// of the previous page.
+func Activity(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	switch {
+	case err != nil || limit <= 0:
+		limit = 50
+	case limit > maxActivity:
+		limit = maxActivity
+	}
+	query := db.C.Where("actor_id = ?", userID)
+	if before, err := strconv.ParseUint(c.Query("before"), 10, 64); err == nil {
+		query = query.Where("id < ?", before)
+	}
+	var events []models.AuditEvent
+	dbReq := query.Order("id desc").Limit(limit).Find(&events)
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot find events:", dbReq.Error)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find events."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// Columns of the CSV export.
+var auditColumns = []string{
+	"ID", "CreatedAt", "ActorID", "Actor", "Action", "FileID", "Target",
+	"IP", "UserAgent", "Outcome", "Detail", "RequestID",
+}
+
+// Returns the value prefixed by a quote if it starts like a formula, so
+// spreadsheets show the client-controlled text instead of running it.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// Streams the audit log as JSON Lines or CSV by the "format" query,
+// oldest first. The "user" query selects the events of an actor, the
+// "from" and "to" queries (RFC 3339) the time range.
+func AuditExport(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	format := c.DefaultQuery("format", "jsonl")
+	if format != "jsonl" && format != "csv" {
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Format must be jsonl or csv."},
+		)
+		return
+	}
+	query := db.C.WithContext(c.Request.Context()).Model(&models.AuditEvent{})
+	if user := c.Query("user"); user != "" {
+		actorID, err := strconv.ParseUint(user, 10, 64)
+		if err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "User must be an ID."},
+			)
+			return
+		}
+		query = query.Where("actor_id = ?", actorID)
+	}
+	for param, condition := range map[string]string{
+		"from": "created_at >= ?",
+		"to":   "created_at < ?",
+	} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Time must be in RFC 3339 format."},
+			)
+			return
+		}
+		query = query.Where(condition, t)
+	}
+	name := "audit-" + time.Now().Format("20060102-150405") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	var write func(e *models.AuditEvent) error
+	var flush func() error
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		w := csv.NewWriter(c.Writer)
+		w.Write(auditColumns)
+		write = func(e *models.AuditEvent) error {
+			return w.Write([]string{
+				strconv.FormatUint(uint64(e.ID), 10),
+				e.CreatedAt.Format(time.RFC3339),
+				strconv.FormatUint(uint64(e.ActorID), 10),
+				csvCell(e.Actor),
+				e.Action,
+				strconv.FormatUint(uint64(e.FileID), 10),
+				csvCell(e.Target),
+				csvCell(e.IP),
+				csvCell(e.UserAgent),
+				e.Outcome,
+				csvCell(e.Detail),
+				csvCell(e.RequestID),
+			})
+		}
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	} else {
+		c.Header("Content-Type", "application/jsonl; charset=utf-8")
+		encoder := json.NewEncoder(c.Writer)
+		write = func(e *models.AuditEvent) error {
+			return encoder.Encode(e)
+		}
+		flush = func() error { return nil }
+	}
+	c.Status(http.StatusOK)
+	var events []models.AuditEvent
+	dbReq := query.Order("id").FindInBatches(&events, 500, func(*gorm.DB, int) error {
+		for i := range events {
+			if err := write(&events[i]); err != nil {
+				return err
+			}
+		}
+		return flush()
+	})
+	if dbReq.Error != nil {
+		// The status is sent, the export is cut off.
+		log.Error(logging.F()+"() cannot export events:", dbReq.Error)
+	}
+}
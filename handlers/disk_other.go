@@ -0,0 +1,8 @@
+//go:build !unix
+
+package handlers
+
+// The free space check is skipped on systems without statfs.
+func freeSpace(string) (int64, error) {
+	return 0, ErrNoDiskSupport
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package handlers
+
+import "golang.org/x/sys/unix"
+
+// Returns the bytes available to unprivileged users on the file system
+// of the path.
+func freeSpace(path string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"spa-api/events"
+	"spa-api/logging"
+	"spa-api/models"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Interval of the comments that keep idle streams open through proxies.
+var EventsHeartbeat = 30 * time.Second
+
+// Streams the file events of the user as server-sent events. The first
+// event is "ready", then every event is named by its type and carries
+// the file. The stream ends when the client disconnects, the access
+// token expires ("expired" event), the token or API key is revoked
+// ("revoked" event, checked on every heartbeat) or the server shuts
+// down, so the client reconnects with a fresh token and fetches the
+// file list again.
+func Events(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	ch, cancel := events.Subscribe(userID)
+	defer cancel()
+	// API keys have no expiration time.
+	var expire <-chan time.Time
+	if exp, ok := claims["exp"].(float64); ok {
+		timer := time.NewTimer(time.Until(time.Unix(int64(exp), 0)))
+		defer timer.Stop()
+		expire = timer.C
+	}
+	heartbeat := time.NewTicker(EventsHeartbeat)
+	defer heartbeat.Stop()
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.SSEvent("ready", gin.H{})
+	c.Writer.Flush()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return false
+			}
+			c.SSEvent(e.Type, e.File)
+			return true
+		case <-heartbeat.C:
+			if streamRevoked(c, claims) {
+				c.SSEvent("revoked", gin.H{})
+				return false
+			}
+			_, err := io.WriteString(w, ": heartbeat\n\n")
+			return err == nil
+		case <-expire:
+			c.SSEvent("expired", gin.H{})
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// Reports whether the credentials of the stream were revoked after it
+// started: logout, revocation of the session or the API key, or the
+// user was disabled.
+func streamRevoked(c *gin.Context, claims jwt.MapClaims) bool {
+	if key, ok := c.Get("api_key"); ok {
+		return CheckAPIKey(key.(*models.APIKey)) != nil
+	}
+	_, err := CheckToken(claims)
+	return err != nil
+}
@@ -1,15 +1,26 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/mail"
 	"os"
 	"path/filepath"
 	"sort"
+	"spa-api/config"
 	db "spa-api/database"
+	"spa-api/events"
 	"spa-api/logging"
+	"spa-api/metrics"
 	"spa-api/models"
+	"spa-api/notify"
+	"spa-api/passwords"
+	"spa-api/tracing"
 	"strings"
 	"sync"
 	"time"
@@ -17,18 +28,80 @@ import (
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
 )
 
 var log = logging.Config
 
-// Login handler for gin-jwt/v2 middleware.
-func LogIn(c *gin.Context) (interface{}, error) {
-	var loginVals models.User
+// Account lockout parameters. After MaxFailedLogins wrong passwords in a
+// row the account is locked for LockoutTime.
+var (
+	MaxFailedLogins int
+	LockoutTime     time.Duration
+)
+
+var ErrAccountLocked = errors.New("account is temporarily locked")
+
+// Requirements of new passwords.
+var PasswordPolicy *passwords.Policy
+
+// Hashing of passwords, outdated hashes are replaced on login.
+var PasswordHasher *passwords.Hasher
+
+func init() {
+	config.OnLoad(configure)
+}
+
+// Copies the settings of the configuration to the package variables.
+func configure(c *config.Config) {
+	MaxFailedLogins = c.Auth.MaxFailedLogins
+	LockoutTime = c.Auth.LockoutTime
+	ResetTimeout = c.Auth.ResetTimeout
+	VerifyTimeout = c.Auth.VerifyTimeout
+	RefreshTimeout = c.JWT.RefreshTimeout
+	SignUpDisabled = c.Auth.SignUpDisabled
+	*LDAP = LDAPProvider{
+		URL:          c.LDAP.URL,
+		StartTLS:     c.LDAP.StartTLS,
+		BindDN:       c.LDAP.BindDN,
+		BindPassword: c.LDAP.BindPassword,
+		BaseDN:       c.LDAP.BaseDN,
+		UserFilter:   c.LDAP.UserFilter,
+		GroupAttr:    c.LDAP.GroupAttr,
+		GroupRoles:   ParseGroupRoles(c.LDAP.GroupRoles),
+	}
+	Providers = providers(c.Auth.Providers)
+	OIDC = OIDCConfig{
+		Issuer:       c.OIDC.Issuer,
+		ClientID:     c.OIDC.ClientID,
+		ClientSecret: c.OIDC.ClientSecret,
+		RedirectURL:  c.OIDC.RedirectURL,
+	}
+	Mailer = notify.New(c.Mail)
+	MailDomain = c.Mail.Domain
+	ResetURL = c.Mail.ResetURL
+	VerifyURL = c.Mail.VerifyURL
+	policy, err := passwords.NewPolicy(c.Password)
+	if err != nil {
+		log.Fatal(logging.F()+"() cannot open breached password list:", err)
+	}
+	PasswordPolicy = policy
+	PasswordHasher = passwords.NewHasher(c.Password)
+}
+
+// Login handler for gin-jwt/v2 middleware. Every attempt with login
+// values is recorded in the audit log.
+func LogIn(c *gin.Context) (data interface{}, err error) {
+	log := logging.Ctx(c.Request.Context())
+	var loginVals struct {
+		Username string
+		Password string
+		Code     string
+	}
 	if err := c.ShouldBind(&loginVals); err != nil {
 		log.WithFields(logrus.Fields{
 			"username": loginVals.Username,
-			"password": loginVals.Password,
 		}).Error(logging.F()+"() parsing error:", err)
 		return "", jwt.ErrMissingLoginValues
 	}
@@ -36,46 +109,168 @@ func LogIn(c *gin.Context) (interface{}, error) {
 	password := loginVals.Password
 	log.WithFields(logrus.Fields{
 		"username": username,
-		"password": password,
 	}).Debug(logging.F() + "() login values:")
+	var actorID uint
+	defer func() {
+		result, detail := outcome(err)
+		audit(c, models.AuditEvent{
+			ActorID: actorID,
+			Actor:   username,
+			Action:  models.ActionLogin,
+			Outcome: result,
+			Detail:  detail,
+		})
+	}()
+	// The local entry may not exist for users of external providers.
+	var found *models.User
 	var entry models.User
 	dbReq := db.C.Where("username = ?", username).First(&entry)
+	if dbReq.Error == nil {
+		found = &entry
+		actorID = entry.ID
+		if entry.Disabled {
+			log.WithFields(logrus.Fields{
+				"username": username,
+			}).Warn(logging.F() + "() login to disabled account:")
+			return nil, ErrAccountDisabled
+		}
+		if entry.LockedUntil.After(time.Now()) {
+			log.WithFields(logrus.Fields{
+				"username": username,
+				"until":    entry.LockedUntil,
+			}).Warn(logging.F() + "() login to locked account:")
+			return nil, ErrAccountLocked
+		}
+	}
+	user, err := authenticate(username, password, found)
+	if err != nil {
+		if found != nil && err == jwt.ErrFailedAuthentication {
+			failedLogin(c, found)
+		}
+		return nil, err
+	}
+	actorID = user.ID
+	if user.TOTPEnabled {
+		err := secondFactor(user, loginVals.Code)
+		if err != nil {
+			if err == ErrTOTPInvalid {
+				failedLogin(c, user)
+			}
+			// The password is correct, so the request for the code is
+			// not a failure for the login backoff.
+			if err == ErrTOTPRequired {
+				c.Set("totp_required", true)
+			}
+			return nil, err
+		}
+	}
+	if user.FailedLogins > 0 {
+		db.C.Model(user).Update("failed_logins", 0)
+	}
+	session, err := newSession(c, user.ID)
+	if err != nil {
+		log.Error(logging.F()+"() cannot create session:", err)
+		return nil, jwt.ErrFailedTokenCreation
+	}
+	c.Set("session", session)
+	return session, nil
+}
+
+// Counts a failed password comparison for the user. Locks the account
+// for LockoutTime and creates the lockout audit entry when the counter
+// reaches MaxFailedLogins.
+func failedLogin(c *gin.Context, user *models.User) {
+	log := logging.Ctx(c.Request.Context())
+	dbReq := db.C.Model(user).
+		Update("failed_logins", gorm.Expr("failed_logins + 1"))
 	if dbReq.Error != nil {
-		return nil, jwt.ErrFailedAuthentication
+		log.Error(logging.F()+"() cannot count failed login:", dbReq.Error)
+		return
 	}
-	err := bcrypt.CompareHashAndPassword(
-		[]byte(entry.Password),
-		[]byte(password),
-	)
+	db.C.Select("failed_logins").First(user, user.ID)
+	if user.FailedLogins < MaxFailedLogins {
+		return
+	}
+	until := time.Now().Add(LockoutTime)
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{
+			"failed_logins": 0,
+			"locked_until":  until,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.Lockout{
+			UserID: user.ID,
+			IP:     c.ClientIP(),
+			Until:  until,
+		}).Error
+	})
 	if err != nil {
-		return nil, jwt.ErrFailedAuthentication
+		log.Error(logging.F()+"() cannot lock account:", err)
+		return
 	}
-	return &entry, nil
+	log.WithFields(logrus.Fields{
+		"ID":    user.ID,
+		"IP":    c.ClientIP(),
+		"until": until,
+	}).Warn(logging.F() + "() account locked:")
 }
 
 // Add additional payload data to the webtoken of gin-jwt/v2
-// middleware. Return map with user ID.
+// middleware. Return map with user ID, user role, session ID for tokens
+// issued by login and unique token ID for the revocation.
 func Payload(data interface{}) jwt.MapClaims {
-	if v, ok := data.(*models.User); ok {
-		log.WithFields(logrus.Fields{
-			"ID": v.ID,
-		}).Debug(logging.F() + "() ID value")
-		return jwt.MapClaims{
-			"id": v.ID,
-		}
+	claims := jwt.MapClaims{}
+	var userID uint
+	switch v := data.(type) {
+	case *models.User:
+		userID = v.ID
+	case *models.Session:
+		userID = v.UserID
+		claims["sid"] = v.ID
+	default:
+		return claims
 	}
-	return jwt.MapClaims{}
+	claims["id"] = userID
+	var user models.User
+	dbReq := db.C.Select("id", "role").First(&user, userID)
+	if dbReq.Error != nil || user.Role == "" {
+		log.Error(logging.F()+"() cannot find user role:", dbReq.Error)
+		user.Role = models.RoleUser
+	}
+	claims["role"] = user.Role
+	log.WithFields(logrus.Fields{
+		"ID":   claims["id"],
+		"SID":  claims["sid"],
+		"role": claims["role"],
+	}).Debug(logging.F() + "() ID value")
+	jti, err := randomID(16)
+	if err != nil {
+		log.Error(logging.F()+"() token ID generation error:", err)
+	} else {
+		claims["jti"] = jti
+	}
+	return claims
 }
 
 // Sign up handler. Clears user input, hashes the password, creates a
-// new entry in the database. Return a message about the result of
-// data processing.
+// new entry in the database and sends the verification link to the
+// optional mail address. Return a message about the result of data
+// processing.
 func SignUp(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	if SignUpDisabled {
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{"message": "Registration is disabled. Use your company account."},
+		)
+		return
+	}
 	var regVals models.User
 	if err := c.ShouldBind(&regVals); err != nil {
 		log.WithFields(logrus.Fields{
 			"username": regVals.Username,
-			"password": regVals.Password,
 		}).Error(logging.F()+"() parsing error:", err)
 		c.JSON(
 			http.StatusBadRequest,
@@ -86,7 +281,6 @@ func SignUp(c *gin.Context) {
 	user, pass := regVals.Username, regVals.Password
 	log.WithFields(logrus.Fields{
 		"username": user,
-		"password": pass,
 	}).Debug(logging.F() + "() register data:")
 	if user == "" {
 		c.JSON(
@@ -95,24 +289,24 @@ func SignUp(c *gin.Context) {
 		)
 		return
 	}
-	if !checkPass(pass) {
-		c.JSON(
-			http.StatusBadRequest,
-			gin.H{"message": `
-				The password must be at least 16 characters long, contain at
-				least one lowercase letter, one uppercase letter, one number,
-				and one special character.
-			`},
-		)
+	email := strings.TrimSpace(regVals.Email)
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Mail address is invalid."},
+			)
+			return
+		}
+	}
+	if err := checkPass(pass, user, email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
-	hashedPass, err := bcrypt.GenerateFromPassword(
-		[]byte(pass), bcrypt.DefaultCost,
-	)
+	hashedPass, err := hashPassword(pass)
 	if err != nil {
-		log.WithFields(logrus.Fields{
-			"password": pass,
-		}).Error(logging.F()+"() bcrypt hashing error:", err)
+		log.Error(logging.F()+"() hashing error:", err)
 		c.JSON(
 			http.StatusInternalServerError,
 			gin.H{"message": "Failed to register. Password problem."},
@@ -121,52 +315,65 @@ func SignUp(c *gin.Context) {
 	}
 	entry := models.User{
 		Username: user,
-		Password: string(hashedPass),
+		Password: hashedPass,
+		Email:    email,
 	}
 	dbReq := db.C.Create(&entry)
 	if dbReq.Error != nil {
+		audit(c, models.AuditEvent{
+			Actor:   user,
+			Action:  models.ActionSignUp,
+			Outcome: models.OutcomeFailure,
+			Detail:  "user exists",
+		})
 		c.JSON(
 			http.StatusConflict,
 			gin.H{"message": "Failed to register. This user exists."},
 		)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Success registration."})
-}
-
-// Checks that the password consists only of ASCII characters, is at
-// least 16 characters long, contains at least one lowercase letter,
-// one uppercase letter, one digit, and one special character. Returns
-// true if the password matches the requirements, false otherwise.
-func checkPass(password string) bool {
-	if len(password) < 16 {
-		return false
+	audit(c, models.AuditEvent{
+		ActorID: entry.ID,
+		Actor:   user,
+		Action:  models.ActionSignUp,
+		Outcome: models.OutcomeSuccess,
+	})
+	if email == "" {
+		c.JSON(http.StatusOK, gin.H{"message": "Success registration."})
+		return
 	}
-	hasLower := false
-	hasUpper := false
-	hasDigit := false
-	hasSpecial := false
-	for _, char := range password {
-		switch {
-		case 'a' <= char && char <= 'z':
-			hasLower = true
-		case 'A' <= char && char <= 'Z':
-			hasUpper = true
-		case '0' <= char && char <= '9':
-			hasDigit = true
-		default:
-			if char < 32 || char > 126 {
-				return false
-			}
-			hasSpecial = true
-		}
+	// The link can be sent again after login, so the account is kept.
+	if err := sendVerification(&entry); err != nil {
+		log.Error(logging.F()+"() cannot send verification link:", err)
 	}
-	return hasLower && hasUpper && hasDigit && hasSpecial
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Success registration. Check your mail to verify the address.",
+	})
+}
+
+// Checks the password against PasswordPolicy. User inputs such as the
+// username make the password weaker if it contains them. Returns an
+// error with a message for the user if the password does not match the
+// requirements.
+func checkPass(password string, userInputs ...string) error {
+	return PasswordPolicy.Check(password, userInputs...)
+}
+
+// Returns the hash of the password for the database.
+func hashPassword(password string) (string, error) {
+	return PasswordHasher.Hash(PasswordPolicy.Prepare(password))
+}
+
+// Reports whether the password matches the hash from the database.
+func verifyPassword(hash, password string) bool {
+	ok, _ := PasswordHasher.Verify(hash, PasswordPolicy.Prepare(password))
+	return ok
 }
 
 // Return a map with a list of files for a specific user. Data can be
 // sorted in ascending and descending order by a column name.
 func List(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
 	sortOrd := c.Query("ord")
 	sortCol := c.Query("col")
 	log.WithFields(logrus.Fields{
@@ -233,6 +440,7 @@ func List(c *gin.Context) {
 // Return the specified by file ID and user ID file into the body
 // stream.
 func Download(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
 	fileID := c.Query("id")
 	claims := jwt.ExtractClaims(c)
 	userID := uint(claims["id"].(float64))
@@ -240,33 +448,117 @@ func Download(c *gin.Context) {
 		"ID": userID,
 	}).Debug(logging.F() + "() token ID value:")
 	var entry models.File
-	dbReq := db.C.First(&entry, "id = ? AND user_id = ?", fileID, userID)
+	dbReq := db.C.WithContext(c.Request.Context()).
+		First(&entry, "id = ? AND user_id = ?", fileID, userID)
 	if dbReq.Error != nil {
 		log.Error(logging.F()+"() cannot find entry:", dbReq.Error)
+		audit(c, models.AuditEvent{
+			ActorID: userID,
+			Action:  models.ActionDownload,
+			Target:  fileID,
+			Outcome: models.OutcomeFailure,
+			Detail:  "entry not found",
+		})
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find an entry."})
 		return
 	}
 	log.WithFields(logrus.Fields{
 		"file": entry,
 	}).Debug(logging.F() + "() entry for Blob response:")
+	_, span := tracing.Storage(c.Request.Context(), "read", entry.Path)
 	c.File(entry.Path)
+	span.SetAttributes(attribute.Int("file.bytes_sent", c.Writer.Size()))
+	tracing.End(span, nil)
+	if size := c.Writer.Size(); size > 0 {
+		metrics.DownloadedBytes.Add(float64(size))
+	}
+	event := models.AuditEvent{
+		ActorID: userID,
+		Action:  models.ActionDownload,
+		FileID:  entry.ID,
+		Target:  entry.Name,
+		Outcome: models.OutcomeSuccess,
+	}
+	if c.Writer.Status() >= http.StatusBadRequest {
+		event.Outcome = models.OutcomeFailure
+		event.Detail = http.StatusText(c.Writer.Status())
+	}
+	audit(c, event)
+}
+
+// Returns the personal directory of the user files.
+func userDir(userID uint) string {
+	dir := config.Get().Storage.UploadDir
+	if gin.Mode() == gin.TestMode {
+		return filepath.Join(dir, "test", fmt.Sprintf("%d", userID))
+	}
+	return filepath.Join(dir, fmt.Sprintf("%d", userID))
+}
+
+// Suffix of files that are being uploaded.
+const partialSuffix = ".part"
+
+// Deletes the partial files of interrupted uploads and their database
+// entries. Called at the start and at the shutdown of the server.
+func CleanPartialUploads() {
+	dir := config.Get().Storage.UploadDir
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, partialSuffix) {
+			return nil
+		}
+		final := strings.TrimSuffix(path, partialSuffix)
+		log.WithFields(logrus.Fields{
+			"path": final,
+		}).Warn(logging.F() + "() deleting interrupted upload:")
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		return db.C.Unscoped().Where("path = ?", final).Delete(&models.File{}).Error
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Error(logging.F()+"() cannot clean partial uploads:", err)
+	}
+}
+
+// Returns the media type of the file content and whether it matches
+// an allowed type, "image/png" or "image/*". Any type is allowed if
+// the list is empty.
+func allowedType(file *multipart.FileHeader, allowed []string) (string, bool) {
+	if len(allowed) == 0 {
+		return "", true
+	}
+	f, err := file.Open()
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	for _, t := range allowed {
+		if t == mediaType ||
+			strings.HasSuffix(t, "/*") &&
+				strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+			return mediaType, true
+		}
+	}
+	return mediaType, false
 }
 
 // Checks the uniqueness of the file in the user's folder, saves the
 // file and creates an entry in the database. Return a message about
 // the result of data processing.
 func Upload(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
 	claims := jwt.ExtractClaims(c)
 	userID := uint(claims["id"].(float64))
 	log.WithFields(logrus.Fields{
 		"ID": userID,
 	}).Debug(logging.F() + "() token ID value:")
-	userDir := ""
-	if gin.Mode() == gin.TestMode {
-		userDir = filepath.Join("./upload/test/", fmt.Sprintf("%d", userID))
-	} else {
-		userDir = filepath.Join("./upload/", fmt.Sprintf("%d", userID))
-	}
+	userDir := userDir(userID)
 	log.WithFields(logrus.Fields{
 		"userDir": userDir,
 	}).Debug(logging.F() + "() personal user directory: ")
@@ -279,10 +571,16 @@ func Upload(c *gin.Context) {
 	log.WithFields(logrus.Fields{
 		"files": files,
 	}).Debug(logging.F() + "() files list from MultipartForm:")
+	if !checkUpload(c, userID, files) {
+		return
+	}
 	loadList := []string{}
 	var tasksGroup sync.WaitGroup
 	chSemaphore := make(chan int, 3)
 	var status int
+	// Guards the status and the list of the upload goroutines.
+	var resultMu sync.Mutex
+	metrics.UploadQueue.Add(float64(len(files)))
 	for _, file := range files {
 		tasksGroup.Add(1)
 		chSemaphore <- 1
@@ -292,6 +590,10 @@ func Upload(c *gin.Context) {
 			tg *sync.WaitGroup,
 		) {
 			defer tg.Done()
+			defer func() { <-ch }()
+			metrics.UploadQueue.Dec()
+			metrics.UploadWorkers.Inc()
+			defer metrics.UploadWorkers.Dec()
 			fileBase := filepath.Base(file.Filename)
 			filePath := filepath.Join(userDir, fileBase)
 			fileExt := filepath.Ext(fileBase)
@@ -330,20 +632,69 @@ func Upload(c *gin.Context) {
 				Date:      time.Now(),
 				Size:      file.Size,
 			}
-			dbReq := db.C.Create(&entry)
+			ctx := c.Request.Context()
+			dbReq := db.C.WithContext(ctx).Create(&entry)
 			if dbReq.Error != nil {
 				log.Errorf(
 					logging.F()+"() %v is not unique: %v",
 					fileBase,
 					dbReq.Error,
 				)
+				audit(c, models.AuditEvent{
+					ActorID: userID,
+					Action:  models.ActionUpload,
+					Target:  entry.Name,
+					Outcome: models.OutcomeFailure,
+					Detail:  "file exists",
+				})
+				resultMu.Lock()
 				status = http.StatusConflict
 				loadList = append(loadList, fileBase+" FAILED!")
+				resultMu.Unlock()
+				return
+			}
+			// The file gets its name when it is complete, partial files
+			// of interrupted uploads are deleted by CleanPartialUploads().
+			partial := filePath + partialSuffix
+			_, span := tracing.Storage(ctx, "save", filePath)
+			span.SetAttributes(attribute.Int64("file.size", file.Size))
+			err := c.SaveUploadedFile(file, partial)
+			if err == nil {
+				err = os.Rename(partial, filePath)
+			}
+			tracing.End(span, err)
+			// The error has server paths, the log has the details.
+			result, detail := outcome(err)
+			if err != nil {
+				detail = "save failed"
+			}
+			audit(c, models.AuditEvent{
+				ActorID: userID,
+				Action:  models.ActionUpload,
+				FileID:  entry.ID,
+				Target:  entry.Name,
+				Outcome: result,
+				Detail:  detail,
+			})
+			if err != nil {
+				log.Error(logging.F()+"() cannot save file:", err)
+				os.Remove(partial)
+				db.C.WithContext(ctx).Unscoped().Delete(&entry)
+				resultMu.Lock()
+				status = http.StatusInternalServerError
+				loadList = append(loadList, fileBase+" FAILED!")
+				resultMu.Unlock()
 				return
 			}
-			c.SaveUploadedFile(file, filePath)
+			metrics.UploadedBytes.Add(float64(file.Size))
+			events.Publish(events.Event{
+				Type:   events.FileCreated,
+				UserID: userID,
+				File:   entry,
+			})
+			resultMu.Lock()
 			loadList = append(loadList, fileBase)
-			<-ch
+			resultMu.Unlock()
 		}(file, chSemaphore, &tasksGroup)
 	}
 	tasksGroup.Wait()
@@ -362,9 +713,74 @@ func Upload(c *gin.Context) {
 	c.JSON(status, gin.H{"message": message})
 }
 
+// Checks that the mail address of the user is verified and the files
+// fit into the storage quota. Sends an error response and returns false
+// otherwise.
+func checkUpload(c *gin.Context, userID uint, files []*multipart.FileHeader) bool {
+	log := logging.Ctx(c.Request.Context())
+	var user models.User
+	if err := db.C.First(&user, userID).Error; err != nil {
+		log.Error(logging.F()+"() cannot find user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return false
+	}
+	if unverified(&user) {
+		c.JSON(
+			http.StatusForbidden,
+			gin.H{"message": "Verify your mail address to upload files."},
+		)
+		return false
+	}
+	allowed := config.Get().Storage.AllowedTypes
+	for _, file := range files {
+		if mediaType, ok := allowedType(file, allowed); !ok {
+			log.WithFields(logrus.Fields{
+				"ID":   userID,
+				"file": file.Filename,
+				"type": mediaType,
+			}).Warn(logging.F() + "() file type is not allowed:")
+			c.JSON(
+				http.StatusUnsupportedMediaType,
+				gin.H{"message": "File type is not allowed: " + file.Filename},
+			)
+			return false
+		}
+	}
+	limit := quotaOf(&user)
+	if limit == 0 {
+		return true
+	}
+	_, size, err := usage(userID)
+	if err != nil {
+		log.Error(logging.F()+"() cannot count usage:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Can't count usage."},
+		)
+		return false
+	}
+	for _, file := range files {
+		size += file.Size
+	}
+	if size > limit {
+		log.WithFields(logrus.Fields{
+			"ID":    userID,
+			"size":  size,
+			"quota": limit,
+		}).Warn(logging.F() + "() quota exceeded:")
+		c.JSON(
+			http.StatusRequestEntityTooLarge,
+			gin.H{"message": "Storage quota exceeded."},
+		)
+		return false
+	}
+	return true
+}
+
 // Changes the Name and ListName entries for the specified user file.
 // Return a message about the result of data processing.
 func Rename(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
 	claims := jwt.ExtractClaims(c)
 	userID := uint(claims["id"].(float64))
 	log.WithFields(logrus.Fields{
@@ -388,17 +804,32 @@ func Rename(c *gin.Context) {
 		"Name":      renameVals.Name,
 		"Extension": renameVals.Extension,
 	}).Debug(logging.F() + "() renaming values:")
+	name := fmt.Sprintf(
+		"/%d/%s%s",
+		userID,
+		renameVals.Name,
+		renameVals.Extension,
+	)
 	dbReq := db.C.Model(&models.File{}).
 		Where("id = ? AND user_id = ?", renameVals.ID, userID).
 		Updates(map[string]interface{}{
-			"name": fmt.Sprintf(
-				"/%d/%s%s",
-				userID,
-				renameVals.Name,
-				renameVals.Extension,
-			),
+			"name":      name,
 			"list_name": renameVals.Name,
 		})
+	event := models.AuditEvent{
+		ActorID: userID,
+		Action:  models.ActionRename,
+		FileID:  renameVals.ID,
+		Target:  name,
+		Outcome: models.OutcomeSuccess,
+	}
+	switch {
+	case dbReq.Error != nil:
+		event.Outcome, event.Detail = models.OutcomeFailure, "name exists"
+	case dbReq.RowsAffected == 0:
+		event.Outcome, event.Detail = models.OutcomeFailure, "entry not found"
+	}
+	audit(c, event)
 	if dbReq.Error != nil {
 		c.JSON(
 			http.StatusBadRequest,
@@ -412,12 +843,21 @@ func Rename(c *gin.Context) {
 		)
 		return
 	}
+	var entry models.File
+	if dbReq.RowsAffected > 0 && db.C.First(&entry, renameVals.ID).Error == nil {
+		events.Publish(events.Event{
+			Type:   events.FileRenamed,
+			UserID: userID,
+			File:   entry,
+		})
+	}
 	c.JSON(http.StatusOK, gin.H{})
 }
 
 // Deletes a file from the user's folder and its record from the
 // database. Return a message about the result of data processing.
 func Delete(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
 	claims := jwt.ExtractClaims(c)
 	userID := uint(claims["id"].(float64))
 	log.WithFields(logrus.Fields{
@@ -437,18 +877,42 @@ func Delete(c *gin.Context) {
 	log.WithFields(logrus.Fields{
 		"ID": delVals.ID,
 	}).Debug(logging.F() + "() deleting ID:")
+	tx := db.C.WithContext(c.Request.Context())
 	var entry models.File
-	dbReq := db.C.First(&entry, "id = ? AND user_id = ?", delVals.ID, userID)
+	dbReq := tx.First(&entry, "id = ? AND user_id = ?", delVals.ID, userID)
 	if dbReq.Error != nil {
 		log.Error(logging.F()+"() cannot find entry:", dbReq.Error)
+		audit(c, models.AuditEvent{
+			ActorID: userID,
+			Action:  models.ActionDelete,
+			FileID:  delVals.ID,
+			Outcome: models.OutcomeFailure,
+			Detail:  "entry not found",
+		})
 		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find an entry."})
 		return
 	}
+	_, span := tracing.Storage(c.Request.Context(), "delete", entry.Path)
 	err := os.Remove(entry.Path)
+	tracing.End(span, err)
+	result, detail := outcome(err)
+	audit(c, models.AuditEvent{
+		ActorID: userID,
+		Action:  models.ActionDelete,
+		FileID:  entry.ID,
+		Target:  entry.Name,
+		Outcome: result,
+		Detail:  detail,
+	})
 	if err != nil {
 		log.Error(logging.F()+"() removing error: ", err)
 		return
 	}
-	db.C.Unscoped().Delete(&entry)
+	tx.Unscoped().Delete(&entry)
+	events.Publish(events.Event{
+		Type:   events.FileDeleted,
+		UserID: userID,
+		File:   entry,
+	})
 	c.JSON(http.StatusOK, gin.H{})
 }
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"spa-api/config"
+	db "spa-api/database"
+	"spa-api/keys"
+	"spa-api/logging"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Maximal duration of all readiness checks of a request.
+const checkTimeout = 5 * time.Second
+
+// Interval of the write test of the upload directory. Probes come every
+// few seconds, so the result of the last test is reused meanwhile.
+const writeTestInterval = 30 * time.Second
+
+var writeTest struct {
+	sync.Mutex
+	dir  string
+	time time.Time
+	err  error
+}
+
+var (
+	ErrNotConnected  = errors.New("database is not connected")
+	ErrLowDiskSpace  = errors.New("free disk space is low")
+	ErrNoDiskSupport = errors.New("free disk space is unknown on this system")
+)
+
+// Dependency of the service checked by the readiness endpoints.
+type check struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Result of a check in the /healthz response.
+type checkResult struct {
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func checks(signing *keys.Set) []check {
+	return []check{
+		{"database", checkDatabase},
+		{"storage", checkStorage},
+		{"keys", func(context.Context) error { return signing.Check() }},
+	}
+}
+
+// Runs the checks and returns their results and whether all passed.
+// Failures are logged.
+func runChecks(ctx context.Context, list []check) (map[string]checkResult, bool) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	results := make(map[string]checkResult, len(list))
+	ready := true
+	for _, ch := range list {
+		start := time.Now()
+		err := ch.run(ctx)
+		result := checkResult{
+			Status:   "ok",
+			Duration: time.Since(start).String(),
+		}
+		if err != nil {
+			ready = false
+			result.Status = "fail"
+			result.Error = err.Error()
+			log.WithFields(logrus.Fields{
+				"check": ch.name,
+			}).Error(logging.F()+"() check failed:", err)
+		}
+		results[ch.name] = result
+	}
+	return results, ready
+}
+
+func checkDatabase(ctx context.Context) error {
+	if db.C == nil {
+		return ErrNotConnected
+	}
+	pool, err := db.C.DB()
+	if err != nil {
+		return err
+	}
+	return pool.PingContext(ctx)
+}
+
+// Checks that a file can be created in the upload directory and that
+// the file system has the minimal free space.
+func checkStorage(context.Context) error {
+	settings := config.Get().Storage
+	if err := checkWrite(settings.UploadDir); err != nil {
+		return err
+	}
+	if settings.MinFreeSpace == 0 {
+		return nil
+	}
+	free, err := freeSpace(settings.UploadDir)
+	if errors.Is(err, ErrNoDiskSupport) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < settings.MinFreeSpace {
+		return fmt.Errorf("%w: %d bytes", ErrLowDiskSpace, free)
+	}
+	return nil
+}
+
+// Creates and deletes a file in the directory, at most once in
+// writeTestInterval.
+func checkWrite(dir string) error {
+	writeTest.Lock()
+	defer writeTest.Unlock()
+	if writeTest.dir == dir && time.Since(writeTest.time) < writeTestInterval {
+		return writeTest.err
+	}
+	err := func() error {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+		file, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		return os.Remove(file.Name())
+	}()
+	writeTest.dir, writeTest.time, writeTest.err = dir, time.Now(), err
+	return err
+}
+
+// Liveness probe. The process answers, the dependencies are not
+// checked, so an unavailable database does not restart the service.
+func Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readiness probe. Returns 200 if the service can handle requests and
+// 503 otherwise, without details.
+func Ready(signing *keys.Set) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		if _, ready := runChecks(c.Request.Context(), checks(signing)); !ready {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// Health of the service for operators. Returns the readiness status
+// with the result of every check, so it is served by the internal
+// listener or to admins only.
+func Health(signing *keys.Set) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		results, ready := runChecks(c.Request.Context(), checks(signing))
+		status, code := "ok", http.StatusOK
+		if !ready {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+		c.JSON(code, gin.H{"status": status, "checks": results})
+	}
+}
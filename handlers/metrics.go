@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"spa-api/config"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/metrics"
+	"spa-api/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	metrics.Registry.MustRegister(storageCollector{})
+}
+
+var (
+	storageFilesDesc = prometheus.NewDesc(
+		"storage_files",
+		"Stored files of all users.",
+		nil, nil,
+	)
+	storageUsedDesc = prometheus.NewDesc(
+		"storage_used_bytes",
+		"Total size of the stored files of all users.",
+		nil, nil,
+	)
+	storageFreeDesc = prometheus.NewDesc(
+		"storage_free_bytes",
+		"Free space of the file system of the upload directory.",
+		nil, nil,
+	)
+)
+
+// Storage usage gauges, read from the database and the file system
+// when the metrics are scraped.
+type storageCollector struct{}
+
+func (storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storageFilesDesc
+	ch <- storageUsedDesc
+	ch <- storageFreeDesc
+}
+
+func (storageCollector) Collect(ch chan<- prometheus.Metric) {
+	if db.C != nil {
+		var result struct {
+			Files int64
+			Size  int64
+		}
+		err := db.C.Model(&models.File{}).
+			Select("count(*) AS files, coalesce(sum(size), 0) AS size").
+			Scan(&result).Error
+		if err != nil {
+			log.Error(logging.F()+"() cannot count usage:", err)
+		} else {
+			ch <- prometheus.MustNewConstMetric(
+				storageFilesDesc, prometheus.GaugeValue, float64(result.Files))
+			ch <- prometheus.MustNewConstMetric(
+				storageUsedDesc, prometheus.GaugeValue, float64(result.Size))
+		}
+	}
+	free, err := freeSpace(config.Get().Storage.UploadDir)
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(
+			storageFreeDesc, prometheus.GaugeValue, float64(free))
+	}
+}
@@ -0,0 +1,641 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	jwt4 "github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// OpenID Connect provider settings. Single sign-on is disabled when
+// Issuer is empty.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // URL of the callback route
+}
+
+var OIDC OIDCConfig
+
+// Lifetime of an authorization request between the login redirect and
+// the callback.
+const oidcStateTimeout = 10 * time.Minute
+
+// Cookie with the hash of the state that binds the authorization
+// request to the browser that started it.
+const oidcStateCookie = "oidc_state"
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// Pending authorization request.
+type oidcState struct {
+	nonce    string
+	verifier string // PKCE code verifier
+	linkUser uint   // user to link the identity to, 0 for login
+	expires  time.Time
+}
+
+// Provider endpoints from the discovery document and signing keys.
+type oidcProvider struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+	keys     map[string]interface{}
+}
+
+// Lifetime of a login ticket between the callback and the second
+// factor.
+const oidcTicketTimeout = 5 * time.Minute
+
+// Login of a user with two-factor authentication that waits for the
+// second factor.
+type oidcTicket struct {
+	userID  uint
+	expires time.Time
+}
+
+var oidcMu sync.Mutex
+var oidcStates = map[string]oidcState{}
+var oidcTickets = map[string]oidcTicket{}
+var oidcCache *oidcProvider
+
+// Returns the provider of the configured issuer. The discovery
+// document is requested once and cached.
+func provider() (*oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcCache != nil && oidcCache.Issuer == OIDC.Issuer {
+		return oidcCache, nil
+	}
+	issuer := strings.TrimSuffix(OIDC.Issuer, "/")
+	var p oidcProvider
+	err := getJSON(issuer+"/.well-known/openid-configuration", &p)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", p.Issuer)
+	}
+	p.Issuer = OIDC.Issuer
+	oidcCache = &p
+	return oidcCache, nil
+}
+
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Returns the signing key by ID. Keys are reloaded when the ID is
+// unknown, so rotation on the provider side is picked up.
+func (p *oidcProvider) key(kid string) (interface{}, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(p.JWKSURL, &set); err != nil {
+		return nil, err
+	}
+	p.keys = map[string]interface{}{}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			p.keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// Creates a pending authorization request and returns the URL of the
+// provider authorization endpoint with PKCE challenge. The state is
+// bound to the client by a cookie checked by OIDCCallback().
+func authorizeURL(c *gin.Context, linkUser uint) (string, error) {
+	p, err := provider()
+	if err != nil {
+		return "", err
+	}
+	state, err := randomID(16)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomID(16)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomID(32)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	oidcMu.Lock()
+	now := time.Now()
+	for k, v := range oidcStates {
+		if now.After(v.expires) {
+			delete(oidcStates, k)
+		}
+	}
+	oidcStates[state] = oidcState{
+		nonce:    nonce,
+		verifier: verifier,
+		linkUser: linkUser,
+		expires:  now.Add(oidcStateTimeout),
+	}
+	oidcMu.Unlock()
+	setStateCookie(c, hashToken(state), int(oidcStateTimeout.Seconds()))
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", OIDC.ClientID)
+	params.Set("redirect_uri", OIDC.RedirectURL)
+	params.Set("scope", "openid profile email")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + params.Encode(), nil
+}
+
+// Sets the HttpOnly state cookie for the callback path, a negative
+// maxAge deletes it.
+func setStateCookie(c *gin.Context, value string, maxAge int) {
+	path := "/"
+	if u, err := url.Parse(OIDC.RedirectURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	secure := c.Request.TLS != nil ||
+		strings.HasPrefix(OIDC.RedirectURL, "https://")
+	// Lax, the provider redirect is a cross-site top-level navigation.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, path, "", secure, true)
+}
+
+// Exchanges the authorization code for tokens and returns verified
+// claims of the ID token.
+func exchange(code string, state oidcState) (jwt4.MapClaims, error) {
+	p, err := provider()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", OIDC.RedirectURL)
+	form.Set("client_id", OIDC.ClientID)
+	form.Set("client_secret", OIDC.ClientSecret)
+	form.Set("code_verifier", state.verifier)
+	resp, err := oidcClient.PostForm(p.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", resp.Status, tokens.Error)
+	}
+	claims := jwt4.MapClaims{}
+	parser := jwt4.NewParser(jwt4.WithValidMethods([]string{"RS256", "ES256"}))
+	_, err = parser.ParseWithClaims(
+		tokens.IDToken,
+		claims,
+		func(t *jwt4.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return p.key(kid)
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(p.Issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+	if !claims.VerifyAudience(OIDC.ClientID, true) {
+		return nil, errors.New("invalid audience")
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != state.nonce {
+		return nil, errors.New("invalid nonce")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("missing subject")
+	}
+	return claims, nil
+}
+
+// Returns a free username based on the identity claims for a new user.
+// Must run in the transaction that creates the user.
+func provisionName(tx *gorm.DB, claims jwt4.MapClaims) (string, error) {
+	name, _ := claims["preferred_username"].(string)
+	if name == "" {
+		email, _ := claims["email"].(string)
+		name, _, _ = strings.Cut(email, "@")
+	}
+	if name == "" {
+		name = "user"
+	}
+	candidate := name
+	for i := 2; i < 100; i++ {
+		var count int64
+		err := tx.Model(&models.User{}).
+			Where("username = ?", candidate).
+			Count(&count).Error
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+	sub, _ := claims["sub"].(string)
+	return name + "-" + hashToken(sub)[:8], nil
+}
+
+// Redirects the client to the provider login page.
+func OIDCLogin(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	if OIDC.Issuer == "" {
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{"message": "Single sign-on is not configured."},
+		)
+		return
+	}
+	target, err := authorizeURL(c, 0)
+	if err != nil {
+		log.Error(logging.F()+"() authorization request error:", err)
+		c.JSON(
+			http.StatusBadGateway,
+			gin.H{"message": "Identity provider is unavailable."},
+		)
+		return
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// Return the provider login URL to link its identity to the current
+// user.
+func OIDCLink(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	if OIDC.Issuer == "" {
+		c.JSON(
+			http.StatusNotFound,
+			gin.H{"message": "Single sign-on is not configured."},
+		)
+		return
+	}
+	target, err := authorizeURL(c, userID)
+	if err != nil {
+		log.Error(logging.F()+"() authorization request error:", err)
+		c.JSON(
+			http.StatusBadGateway,
+			gin.H{"message": "Identity provider is unavailable."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": target})
+}
+
+// Handles the provider redirect. Links the identity to the user that
+// started linking, or logs in the user of the identity. Users are
+// created on the first login. Requests without the state cookie of the
+// client that started the login are rejected. Return tokens like the login route, or a
+// login ticket for OIDCVerify() if the user has two-factor
+// authentication enabled: the provider login does not replace it.
+func OIDCCallback(generate TokenGenerator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		oidcMu.Lock()
+		state, ok := oidcStates[c.Query("state")]
+		delete(oidcStates, c.Query("state"))
+		oidcMu.Unlock()
+		cookie, _ := c.Cookie(oidcStateCookie)
+		setStateCookie(c, "", -1)
+		bound := subtle.ConstantTimeCompare(
+			[]byte(cookie),
+			[]byte(hashToken(c.Query("state"))),
+		) == 1
+		if !bound && ok {
+			log.Warn(logging.F() + "() state cookie does not match:")
+		}
+		if !ok || !bound || time.Now().After(state.expires) {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Login request is expired. Try again."},
+			)
+			return
+		}
+		if e := c.Query("error"); e != "" {
+			log.WithFields(logrus.Fields{
+				"error": e,
+			}).Warn(logging.F() + "() provider returned error:")
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Login was rejected by identity provider."},
+			)
+			return
+		}
+		claims, err := exchange(c.Query("code"), state)
+		if err != nil {
+			log.Error(logging.F()+"() code exchange error:", err)
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Failed to verify identity."},
+			)
+			return
+		}
+		subject := claims["sub"].(string)
+		log.WithFields(logrus.Fields{
+			"issuer":  OIDC.Issuer,
+			"subject": subject,
+		}).Debug(logging.F() + "() verified identity:")
+		var identity models.Identity
+		dbReq := db.C.
+			Where("issuer = ? AND subject = ?", OIDC.Issuer, subject).
+			First(&identity)
+		found := dbReq.Error == nil
+		if state.linkUser != 0 {
+			if found {
+				c.JSON(
+					http.StatusConflict,
+					gin.H{"message": "This identity is already linked."},
+				)
+				return
+			}
+			dbReq := db.C.Create(&models.Identity{
+				UserID:  state.linkUser,
+				Issuer:  OIDC.Issuer,
+				Subject: subject,
+			})
+			if dbReq.Error != nil {
+				log.Error(logging.F()+"() cannot link identity:", dbReq.Error)
+				c.JSON(
+					http.StatusInternalServerError,
+					gin.H{"message": "Failed to link identity."},
+				)
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"message": "Identity linked."})
+			return
+		}
+		var user models.User
+		if found {
+			err = db.C.First(&user, identity.UserID).Error
+		} else {
+			err = db.C.Transaction(func(tx *gorm.DB) error {
+				// Concurrent first logins with the same name wait for
+				// each other, so the free name is not taken twice.
+				err := tx.Exec("LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE").Error
+				if err != nil {
+					return err
+				}
+				name, err := provisionName(tx, claims)
+				if err != nil {
+					return err
+				}
+				// Local login is impossible until the password is set.
+				user = models.User{
+					Username: name,
+					Password: "!",
+					Provider: models.ProviderOIDC,
+				}
+				if err := tx.Create(&user).Error; err != nil {
+					return err
+				}
+				return tx.Create(&models.Identity{
+					UserID:  user.ID,
+					Issuer:  OIDC.Issuer,
+					Subject: subject,
+				}).Error
+			})
+		}
+		if err != nil {
+			log.Error(logging.F()+"() cannot find or create user:", err)
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Failed to log in."},
+			)
+			return
+		}
+		if err := loginAllowed(&user); err != nil {
+			auditSSO(c, &user, err)
+			c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+		if !user.TOTPEnabled {
+			oidcLogIn(c, generate, &user)
+			return
+		}
+		auditSSO(c, &user, ErrTOTPRequired)
+		ticket, err := randomID(32)
+		if err != nil {
+			log.Error(logging.F()+"() ticket generation error:", err)
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Failed to log in."},
+			)
+			return
+		}
+		oidcMu.Lock()
+		now := time.Now()
+		for k, v := range oidcTickets {
+			if now.After(v.expires) {
+				delete(oidcTickets, k)
+			}
+		}
+		oidcTickets[ticket] = oidcTicket{
+			userID:  user.ID,
+			expires: now.Add(oidcTicketTimeout),
+		}
+		oidcMu.Unlock()
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": ErrTOTPRequired.Error(),
+			"ticket":  ticket,
+		})
+	}
+}
+
+// Completes the provider login of a user with two-factor authentication
+// by the ticket of the callback and the second factor. A ticket is used
+// once, invalid codes count as failed logins. Return tokens like the
+// login route.
+func OIDCVerify(generate TokenGenerator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		var vals struct {
+			Ticket string
+			Code   string
+		}
+		if err := c.ShouldBind(&vals); err != nil {
+			log.Error(logging.F()+"() parsing error:", err)
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Failed to log in. Fields missing."},
+			)
+			return
+		}
+		oidcMu.Lock()
+		ticket, ok := oidcTickets[vals.Ticket]
+		delete(oidcTickets, vals.Ticket)
+		oidcMu.Unlock()
+		if !ok || time.Now().After(ticket.expires) {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Login request is expired. Try again."},
+			)
+			return
+		}
+		var user models.User
+		if err := db.C.First(&user, ticket.userID).Error; err != nil {
+			log.Error(logging.F()+"() cannot find user:", err)
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Login request is expired. Try again."},
+			)
+			return
+		}
+		if err := loginAllowed(&user); err != nil {
+			auditSSO(c, &user, err)
+			c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+		if err := secondFactor(&user, vals.Code); err != nil {
+			if err == ErrTOTPInvalid {
+				failedLogin(c, &user)
+			}
+			auditSSO(c, &user, err)
+			c.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+		if user.FailedLogins > 0 {
+			db.C.Model(&user).Update("failed_logins", 0)
+		}
+		oidcLogIn(c, generate, &user)
+	}
+}
+
+// Returns the error of a login to the disabled or locked account.
+func loginAllowed(user *models.User) error {
+	if user.Disabled {
+		return ErrAccountDisabled
+	}
+	if user.LockedUntil.After(time.Now()) {
+		return ErrAccountLocked
+	}
+	return nil
+}
+
+// Records the provider login of the user in the audit log.
+func auditSSO(c *gin.Context, user *models.User, err error) {
+	result, detail := outcome(err)
+	audit(c, models.AuditEvent{
+		ActorID: user.ID,
+		Actor:   user.Username,
+		Action:  models.ActionLogin,
+		Outcome: result,
+		Detail:  detail,
+	})
+}
+
+// Creates a session of the provider login and responds with its tokens.
+func oidcLogIn(c *gin.Context, generate TokenGenerator, user *models.User) {
+	log := logging.Ctx(c.Request.Context())
+	session, err := newSession(c, user.ID)
+	if err != nil {
+		log.Error(logging.F()+"() cannot create session:", err)
+		auditSSO(c, user, jwt.ErrFailedTokenCreation)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to log in."},
+		)
+		return
+	}
+	token, expire, err := generate(session)
+	if err != nil {
+		log.Error(logging.F()+"() cannot create access token:", err)
+		auditSSO(c, user, jwt.ErrFailedTokenCreation)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to create a token."},
+		)
+		return
+	}
+	auditSSO(c, user, nil)
+	c.Set("session", session)
+	LoginResponse(c, http.StatusOK, token, expire)
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"strings"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Authentication provider of the login route. Returns the user of the
+// verified credentials or jwt.ErrFailedAuthentication. The user is the
+// local entry with the same username, nil if it does not exist.
+type Authenticator interface {
+	Authenticate(username, password string, user *models.User) (*models.User, error)
+}
+
+var ErrProviderUnavailable = errors.New("authentication provider is unavailable")
+
+// Providers of the login route in the order of checking ("local" and
+// "ldap").
+var Providers []Authenticator
+
+// Disables the sign up route when the accounts come from a directory.
+var SignUpDisabled bool
+
+func providers(names []string) []Authenticator {
+	list := []Authenticator{}
+	for _, name := range names {
+		switch name {
+		case "local":
+			list = append(list, Local{})
+		case "ldap":
+			list = append(list, LDAP)
+		case "":
+		default:
+			log.Fatal(logging.F()+"() unknown authentication provider:", name)
+		}
+	}
+	if len(list) == 0 {
+		list = append(list, Local{})
+	}
+	return list
+}
+
+// Local accounts with hashed passwords.
+type Local struct{}
+
+func (Local) Authenticate(
+	username, password string,
+	user *models.User,
+) (*models.User, error) {
+	if user == nil || user.Provider == models.ProviderLDAP {
+		return nil, jwt.ErrFailedAuthentication
+	}
+	password = PasswordPolicy.Prepare(password)
+	ok, rehash := PasswordHasher.Verify(user.Password, password)
+	if !ok {
+		return nil, jwt.ErrFailedAuthentication
+	}
+	// The password is known only now, so outdated hashes are replaced
+	// on login.
+	if rehash {
+		hash, err := PasswordHasher.Hash(password)
+		if err == nil {
+			err = db.C.Model(user).Update("password", hash).Error
+		}
+		if err != nil {
+			log.Error(logging.F()+"() cannot rehash password:", err)
+		} else {
+			user.Password = hash
+		}
+	}
+	return user, nil
+}
+
+// LDAP/Active Directory accounts. The user is found by the search with
+// a service account and verified by the bind with its DN and password.
+// Users are created on the first login, the role is updated from the
+// directory groups on every login.
+type LDAPProvider struct {
+	URL          string // ldap://host:389 or ldaps://host:636
+	StartTLS     bool
+	BindDN       string // service account, anonymous search if empty
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // %s is replaced by the escaped username
+	GroupAttr    string
+	GroupRoles   map[string]string // lowercase group DN to role
+}
+
+var LDAP = &LDAPProvider{}
+
+// Parses the group to role mapping in the "group DN:role;group DN:role"
+// format.
+func ParseGroupRoles(value string) map[string]string {
+	roles := map[string]string{}
+	for _, pair := range strings.Split(value, ";") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			continue
+		}
+		group := strings.ToLower(strings.TrimSpace(pair[:i]))
+		roles[group] = strings.TrimSpace(pair[i+1:])
+	}
+	return roles
+}
+
+func (p *LDAPProvider) Authenticate(
+	username, password string,
+	user *models.User,
+) (*models.User, error) {
+	// An empty password means an unauthenticated bind, which succeeds.
+	if p.URL == "" || username == "" || password == "" {
+		return nil, jwt.ErrFailedAuthentication
+	}
+	if user != nil && user.Provider != models.ProviderLDAP {
+		return nil, jwt.ErrFailedAuthentication
+	}
+	conn, err := ldap.DialURL(p.URL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %w", err)
+	}
+	defer conn.Close()
+	if p.StartTLS {
+		host := strings.TrimPrefix(p.URL, "ldap://")
+		host, _, _ = strings.Cut(host, ":")
+		err := conn.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return nil, fmt.Errorf("ldap starttls: %w", err)
+		}
+	}
+	if p.BindDN != "" {
+		if err := conn.Bind(p.BindDN, p.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		p.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, 0, false,
+		fmt.Sprintf(p.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", p.GroupAttr},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, jwt.ErrFailedAuthentication
+		}
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, jwt.ErrFailedAuthentication
+	}
+	entry := result.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, jwt.ErrFailedAuthentication
+		}
+		return nil, fmt.Errorf("ldap user bind: %w", err)
+	}
+	role := models.RoleUser
+	for _, group := range entry.GetAttributeValues(p.GroupAttr) {
+		if r, ok := p.GroupRoles[strings.ToLower(group)]; ok {
+			role = r
+			break
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"username": username,
+		"DN":       entry.DN,
+		"role":     role,
+	}).Debug(logging.F() + "() directory user:")
+	if user == nil {
+		user = &models.User{
+			Username: username,
+			Password: "!", // the password is checked by the directory
+			Provider: models.ProviderLDAP,
+			Role:     role,
+		}
+		if err := db.C.Create(user).Error; err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if user.Role != role {
+		user.Role = role
+		if err := db.C.Model(user).Update("role", role).Error; err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
+
+// Checks the credentials by the configured providers in turn. Return
+// jwt.ErrFailedAuthentication if no provider accepted them.
+func authenticate(username, password string, user *models.User) (*models.User, error) {
+	var failure error
+	for _, p := range Providers {
+		result, err := p.Authenticate(username, password, user)
+		if err == nil {
+			return result, nil
+		}
+		if !errors.Is(err, jwt.ErrFailedAuthentication) {
+			log.WithFields(logrus.Fields{
+				"username": username,
+				"provider": fmt.Sprintf("%T", p),
+			}).Error(logging.F()+"() provider error:", err)
+			failure = err
+		}
+	}
+	if failure != nil {
+		// Unavailable directory must not look like wrong credentials.
+		return nil, ErrProviderUnavailable
+	}
+	return nil, jwt.ErrFailedAuthentication
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Records a login of the user with the client user agent and IP.
+func newSession(c *gin.Context, userID uint) (*models.Session, error) {
+	session := models.Session{
+		UserID:    userID,
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+		LastSeen:  time.Now(),
+	}
+	if err := db.C.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Marks the user session as revoked and revokes its refresh tokens.
+func revokeSession(tx *gorm.DB, userID, sessionID uint) error {
+	dbReq := tx.Model(&models.Session{}).
+		Where("id = ? AND user_id = ?", sessionID, userID).
+		Update("revoked", true)
+	if dbReq.Error != nil {
+		return dbReq.Error
+	}
+	if dbReq.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return tx.Model(&models.RefreshToken{}).
+		Where("session_id = ?", sessionID).
+		Update("revoked", true).Error
+}
+
+// Return a list of active sessions of the user. The session of the
+// current token is marked.
+func Sessions(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	sid, _ := claims["sid"].(float64)
+	var sessions []models.Session
+	dbReq := db.C.
+		Where("user_id = ? AND revoked = ?", userID, false).
+		Where("last_seen > ?", time.Now().Add(-RefreshTimeout)).
+		Order("last_seen desc").
+		Find(&sessions)
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot find sessions:", dbReq.Error)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	list := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, gin.H{
+			"ID":        s.ID,
+			"UserAgent": s.UserAgent,
+			"IP":        s.IP,
+			"CreatedAt": s.CreatedAt,
+			"LastSeen":  s.LastSeen,
+			"Current":   s.ID == uint(sid),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": list})
+}
+
+// Revokes the specified session of the user. Return a message about the
+// result of data processing.
+func RevokeSession(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var vals models.Session
+	if err := c.ShouldBind(&vals); err != nil {
+		log.WithFields(logrus.Fields{
+			"ID": vals.ID,
+		}).Error(logging.F()+"() parsing error:", err)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Cannot revoke a session."},
+		)
+		return
+	}
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		return revokeSession(tx, userID, vals.ID)
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot revoke session:", err)
+		c.JSON(
+			http.StatusBadRequest,
+			gin.H{"message": "Can't find a session."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net/http"
+	db "spa-api/database"
+	"spa-api/keys"
+	"spa-api/logging"
+	"spa-api/models"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Lifetime of a refresh token.
+var RefreshTimeout time.Duration
+
+var ErrTokenRevoked = errors.New("token is revoked")
+
+// Access token generator of the gin-jwt/v2 middleware.
+type TokenGenerator func(data interface{}) (string, time.Time, error)
+
+// Returns a random hex string of n bytes.
+func randomID(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a refresh token for the user session. Only the hash is
+// stored, the token itself is returned to the client once.
+func newRefresh(tx *gorm.DB, userID, sessionID uint) (string, error) {
+	token, err := randomID(32)
+	if err != nil {
+		return "", err
+	}
+	entry := models.RefreshToken{
+		UserID:    userID,
+		SessionID: sessionID,
+		Hash:      hashToken(token),
+		ExpiresAt: time.Now().Add(RefreshTimeout),
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Login response for gin-jwt/v2 middleware. Adds a refresh token for
+// the session created by LogIn.
+func LoginResponse(c *gin.Context, code int, token string, expire time.Time) {
+	log := logging.Ctx(c.Request.Context())
+	response := gin.H{
+		"code":   code,
+		"token":  token,
+		"expire": expire.Format(time.RFC3339),
+	}
+	if v, ok := c.Get("session"); ok {
+		session := v.(*models.Session)
+		refresh, err := newRefresh(db.C, session.UserID, session.ID)
+		if err != nil {
+			log.Error(logging.F()+"() cannot create refresh token:", err)
+		} else {
+			response["refresh"] = refresh
+		}
+	}
+	c.JSON(code, response)
+}
+
+// Exchanges a refresh token for a new access token and a new refresh
+// token. The used refresh token is revoked. Presenting an already
+// revoked token means it was stolen or leaked, so all refresh tokens of
+// the user are revoked.
+func Refresh(generate TokenGenerator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		var vals struct{ Refresh string }
+		if err := c.ShouldBind(&vals); err != nil || vals.Refresh == "" {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Refresh token is missing."},
+			)
+			return
+		}
+		var entry models.RefreshToken
+		dbReq := db.C.Where("hash = ?", hashToken(vals.Refresh)).First(&entry)
+		if dbReq.Error != nil {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Invalid refresh token."},
+			)
+			return
+		}
+		if entry.Revoked {
+			log.WithFields(logrus.Fields{
+				"ID": entry.UserID,
+			}).Warn(logging.F() + "() revoked refresh token reuse:")
+			db.C.Model(&models.RefreshToken{}).
+				Where("user_id = ?", entry.UserID).
+				Update("revoked", true)
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Invalid refresh token."},
+			)
+			return
+		}
+		if entry.ExpiresAt.Before(time.Now()) {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Refresh token is expired."},
+			)
+			return
+		}
+		var user models.User
+		if err := db.C.First(&user, entry.UserID).Error; err != nil {
+			log.Error(logging.F()+"() cannot find user:", err)
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Invalid refresh token."},
+			)
+			return
+		}
+		if user.Disabled {
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": ErrAccountDisabled.Error()},
+			)
+			return
+		}
+		// Tokens issued before sessions were introduced have no session.
+		var data interface{} = &user
+		if entry.SessionID != 0 {
+			var session models.Session
+			dbReq := db.C.First(&session, entry.SessionID)
+			if dbReq.Error != nil || session.Revoked {
+				c.JSON(
+					http.StatusUnauthorized,
+					gin.H{"message": "Session is revoked."},
+				)
+				return
+			}
+			data = &session
+		}
+		var refresh string
+		err := db.C.Transaction(func(tx *gorm.DB) error {
+			// The condition on revoked prevents concurrent reuse.
+			dbReq := tx.Model(&entry).Where("revoked = ?", false).
+				Update("revoked", true)
+			if dbReq.Error != nil {
+				return dbReq.Error
+			}
+			if dbReq.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			var err error
+			refresh, err = newRefresh(tx, user.ID, entry.SessionID)
+			if err != nil {
+				return err
+			}
+			if entry.SessionID == 0 {
+				return nil
+			}
+			return tx.Model(&models.Session{}).
+				Where("id = ?", entry.SessionID).
+				Updates(map[string]interface{}{
+					"last_seen": time.Now(),
+					"ip":        c.ClientIP(),
+				}).Error
+		})
+		if err != nil {
+			log.Error(logging.F()+"() cannot rotate refresh token:", err)
+			c.JSON(
+				http.StatusUnauthorized,
+				gin.H{"message": "Invalid refresh token."},
+			)
+			return
+		}
+		token, expire, err := generate(data)
+		if err != nil {
+			log.Error(logging.F()+"() cannot create access token:", err)
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Failed to create a token."},
+			)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"code":    http.StatusOK,
+			"token":   token,
+			"expire":  expire.Format(time.RFC3339),
+			"refresh": refresh,
+		})
+	}
+}
+
+// Returns the public keys of the webtokens as a JSON Web Key Set, so
+// other services can verify them.
+func JWKS(set *keys.Set) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.JSON(http.StatusOK, set.JWKS())
+	}
+}
+
+// Revokes the current access token, its session and the refresh token
+// from the request body, if specified.
+func LogOut(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var vals struct{ Refresh string }
+	c.ShouldBind(&vals)
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		if jti, ok := claims["jti"].(string); ok {
+			exp, _ := claims["exp"].(float64)
+			err := revokeJTI(tx, jti, time.Unix(int64(exp), 0))
+			if err != nil {
+				return err
+			}
+		}
+		if sid, ok := claims["sid"].(float64); ok {
+			if err := revokeSession(tx, userID, uint(sid)); err != nil {
+				return err
+			}
+		}
+		if vals.Refresh == "" {
+			return nil
+		}
+		return tx.Model(&models.RefreshToken{}).
+			Where("user_id = ? AND hash = ?", userID, hashToken(vals.Refresh)).
+			Update("revoked", true).Error
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot revoke tokens:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to log out."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// Revokes all sessions, access and refresh tokens of the user. API keys
+// are not revoked: they belong to scripts, not to sessions, and are
+// revoked one by one in an interactive session.
+func LogOutAll(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("id = ?", userID).
+			Update("tokens_valid_after", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&models.Session{}).
+			Where("user_id = ?", userID).
+			Update("revoked", true).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).
+			Where("user_id = ?", userID).
+			Update("revoked", true).Error
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot revoke tokens:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to log out."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// Checks the claims of an access token against the revocations: the
+// user is disabled, the token is on the denylist (logout), its session
+// is revoked or it was issued before "log out all sessions" of the
+// user. Returns the session of the token, nil for tokens without one.
+func CheckToken(claims jwt.MapClaims) (*models.Session, error) {
+	id, _ := claims["id"].(float64)
+	iat, _ := claims["orig_iat"].(float64)
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(float64)
+	var user models.User
+	dbReq := db.C.Select("id", "tokens_valid_after", "disabled").
+		First(&user, uint(id))
+	if dbReq.Error != nil {
+		return nil, dbReq.Error
+	}
+	issued := time.UnixMicro(int64(math.Round(iat * 1e6)))
+	if user.Disabled || !issued.After(user.TokensValidAfter) {
+		return nil, ErrTokenRevoked
+	}
+	if jti != "" {
+		var count int64
+		db.C.Model(&models.RevokedToken{}).
+			Where("jti = ?", jti).
+			Count(&count)
+		if count > 0 {
+			return nil, ErrTokenRevoked
+		}
+	}
+	if sid == 0 {
+		return nil, nil
+	}
+	var session models.Session
+	dbReq = db.C.First(&session, uint(sid))
+	if dbReq.Error != nil || session.Revoked {
+		return nil, ErrTokenRevoked
+	}
+	return &session, nil
+}
+
+// Adds the access token ID to the denylist and removes expired entries.
+func revokeJTI(tx *gorm.DB, jti string, expire time.Time) error {
+	err := tx.Where("expires_at < ?", time.Now()).
+		Delete(&models.RevokedToken{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Create(&models.RevokedToken{JTI: jti, ExpiresAt: expire}).Error
+}
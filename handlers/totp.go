@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"strings"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// TOTP parameters (RFC 6238). Most authenticator apps support only
+// these default values.
+const (
+	totpIssuer    = "Web Storage"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1 // accepted time steps before and after current
+	recoveryCount = 10
+)
+
+var (
+	ErrTOTPRequired = errors.New("two-factor authentication code required")
+	ErrTOTPInvalid  = errors.New("invalid two-factor authentication code")
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns the TOTP code of the base32 encoded secret for the specified
+// time.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix()/totpPeriod)), nil
+}
+
+// HMAC-based one-time password (RFC 4226) with dynamic truncation.
+func hotp(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// Checks the code against the time steps around the current one that
+// are later than the last accepted step, so a code cannot be replayed.
+// Returns the matched time step.
+func checkTOTP(secret, code string, last int64) (int64, bool) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= last {
+			continue
+		}
+		expected := hotp(key, uint64(step))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Checks the second factor of the user: a TOTP code or an unused
+// recovery code. Used codes are invalidated.
+func secondFactor(user *models.User, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return ErrTOTPRequired
+	}
+	if step, ok := checkTOTP(user.TOTPSecret, code, user.TOTPStep); ok {
+		user.TOTPStep = step
+		return db.C.Model(user).Update("totp_step", step).Error
+	}
+	dbReq := db.C.Unscoped().
+		Where("user_id = ? AND hash = ?", user.ID, hashCode(code)).
+		Delete(&models.RecoveryCode{})
+	if dbReq.Error != nil {
+		return dbReq.Error
+	}
+	if dbReq.RowsAffected == 0 {
+		return ErrTOTPInvalid
+	}
+	log.WithFields(logrus.Fields{
+		"ID": user.ID,
+	}).Warn(logging.F() + "() recovery code used:")
+	return nil
+}
+
+func hashCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Generates a new TOTP secret for the user and returns it with the
+// otpauth URI for authenticator apps. Two-factor authentication is
+// enabled only after confirmation by a valid code.
+func TOTPEnroll(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var user models.User
+	if err := db.C.First(&user, userID).Error; err != nil {
+		log.Error(logging.F()+"() cannot find user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(
+			http.StatusConflict,
+			gin.H{"message": "Two-factor authentication is already enabled."},
+		)
+		return
+	}
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		log.Error(logging.F()+"() secret generation error:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to generate a secret."},
+		)
+		return
+	}
+	secret := b32.EncodeToString(key)
+	dbReq := db.C.Model(&user).Updates(map[string]interface{}{
+		"totp_secret": secret,
+		"totp_step":   0,
+	})
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot save secret:", dbReq.Error)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to save a secret."},
+		)
+		return
+	}
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + user.Username,
+		RawQuery: params.Encode(),
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": uri.String()})
+}
+
+// Enables two-factor authentication if the code matches the enrolled
+// secret. Return a list of single-use recovery codes.
+func TOTPConfirm(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var vals struct{ Code string }
+	if err := c.ShouldBind(&vals); err != nil {
+		log.Error(logging.F()+"() parsing error:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Code is missing."})
+		return
+	}
+	var user models.User
+	if err := db.C.First(&user, userID).Error; err != nil {
+		log.Error(logging.F()+"() cannot find user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		c.JSON(
+			http.StatusConflict,
+			gin.H{"message": "Nothing to confirm. Enroll first."},
+		)
+		return
+	}
+	step, ok := checkTOTP(user.TOTPSecret, vals.Code, user.TOTPStep)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid code."})
+		return
+	}
+	codes := make([]string, recoveryCount)
+	entries := make([]models.RecoveryCode, recoveryCount)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			log.Error(logging.F()+"() recovery code generation error:", err)
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Failed to generate recovery codes."},
+			)
+			return
+		}
+		code := hex.EncodeToString(buf)
+		codes[i] = code[:5] + "-" + code[5:]
+		entries[i] = models.RecoveryCode{UserID: user.ID, Hash: hashCode(codes[i])}
+	}
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("user_id = ?", user.ID).
+			Delete(&models.RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Create(&entries).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled": true,
+			"totp_step":    step,
+		}).Error
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot enable two-factor:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to enable two-factor authentication."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"codes": codes})
+}
+
+// Disables two-factor authentication after checking a TOTP or recovery
+// code, removes the secret and the recovery codes.
+func TOTPDisable(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	var vals struct{ Code string }
+	if err := c.ShouldBind(&vals); err != nil {
+		log.Error(logging.F()+"() parsing error:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Code is missing."})
+		return
+	}
+	var user models.User
+	if err := db.C.First(&user, userID).Error; err != nil {
+		log.Error(logging.F()+"() cannot find user:", err)
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find user."})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(
+			http.StatusConflict,
+			gin.H{"message": "Two-factor authentication is not enabled."},
+		)
+		return
+	}
+	if err := secondFactor(&user, vals.Code); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Invalid code."})
+		return
+	}
+	err := db.C.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("user_id = ?", user.ID).
+			Delete(&models.RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled": false,
+			"totp_secret":  "",
+			"totp_step":    0,
+		}).Error
+	})
+	if err != nil {
+		log.Error(logging.F()+"() cannot disable two-factor:", err)
+		c.JSON(
+			http.StatusInternalServerError,
+			gin.H{"message": "Failed to disable two-factor authentication."},
+		)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
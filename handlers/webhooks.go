@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	db "spa-api/database"
+	"spa-api/logging"
+	"spa-api/models"
+	"spa-api/webhooks"
+	"strconv"
+	"strings"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Prefix of webhook secrets.
+const WebhookSecretPrefix = "whsec_"
+
+// Returns the owner of the webhooks of the route: the user, or 0 for
+// the admin webhooks that receive the events of all users.
+func webhookOwner(c *gin.Context, global bool) uint {
+	if global {
+		return 0
+	}
+	log := logging.Ctx(c.Request.Context())
+	claims := jwt.ExtractClaims(c)
+	userID := uint(claims["id"].(float64))
+	log.WithFields(logrus.Fields{
+		"ID": userID,
+	}).Debug(logging.F() + "() token ID value:")
+	return userID
+}
+
+// Return a list of webhooks without their secrets.
+func Webhooks(global bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		owner := webhookOwner(c, global)
+		var hooks []models.Webhook
+		dbReq := db.C.Where("user_id = ?", owner).Order("id").Find(&hooks)
+		if dbReq.Error != nil {
+			log.Error(logging.F()+"() cannot find webhooks:", dbReq.Error)
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find webhooks."})
+			return
+		}
+		list := make([]gin.H, 0, len(hooks))
+		for _, h := range hooks {
+			list = append(list, gin.H{
+				"ID":        h.ID,
+				"URL":       h.URL,
+				"Events":    h.Events,
+				"CreatedAt": h.CreatedAt,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"webhooks": list})
+	}
+}
+
+// Creates a webhook for the URL and the event types, all types if none
+// are specified. Return the signing secret, it is shown only once.
+func CreateWebhook(global bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		owner := webhookOwner(c, global)
+		var vals struct {
+			URL    string
+			Events []string
+		}
+		if err := c.ShouldBind(&vals); err != nil {
+			log.WithFields(logrus.Fields{
+				"URL": vals.URL,
+			}).Error(logging.F()+"() parsing error:", err)
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Failed to create a webhook. Fields missing."},
+			)
+			return
+		}
+		u, err := url.Parse(vals.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			u.Host == "" {
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "URL must be an http or https address."},
+			)
+			return
+		}
+		for _, event := range vals.Events {
+			known := false
+			for _, t := range webhooks.Events {
+				known = known || t == event
+			}
+			if !known {
+				c.JSON(
+					http.StatusBadRequest,
+					gin.H{"message": "Unknown event type: " + event},
+				)
+				return
+			}
+		}
+		random, err := randomID(32)
+		if err != nil {
+			log.Error(logging.F()+"() secret generation error:", err)
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Failed to create a webhook."},
+			)
+			return
+		}
+		entry := models.Webhook{
+			UserID: owner,
+			URL:    u.String(),
+			Secret: WebhookSecretPrefix + random,
+			Events: strings.Join(vals.Events, ","),
+		}
+		if err := db.C.Create(&entry).Error; err != nil {
+			log.Error(logging.F()+"() cannot save webhook:", err)
+			c.JSON(
+				http.StatusInternalServerError,
+				gin.H{"message": "Failed to create a webhook."},
+			)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"ID":     entry.ID,
+			"URL":    entry.URL,
+			"Events": entry.Events,
+			"secret": entry.Secret,
+		})
+	}
+}
+
+// Deletes the specified webhook with its deliveries. Return a message
+// about the result of data processing.
+func DeleteWebhook(global bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		owner := webhookOwner(c, global)
+		var vals models.Webhook
+		if err := c.ShouldBind(&vals); err != nil {
+			log.WithFields(logrus.Fields{
+				"ID": vals.ID,
+			}).Error(logging.F()+"() parsing error:", err)
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Cannot delete a webhook."},
+			)
+			return
+		}
+		err := db.C.Transaction(func(tx *gorm.DB) error {
+			dbReq := tx.Unscoped().
+				Where("id = ? AND user_id = ?", vals.ID, owner).
+				Delete(&models.Webhook{})
+			if dbReq.Error != nil {
+				return dbReq.Error
+			}
+			if dbReq.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			return tx.Where("webhook_id = ?", vals.ID).
+				Delete(&models.WebhookDelivery{}).Error
+		})
+		if err != nil {
+			log.Error(logging.F()+"() cannot delete webhook:", err)
+			c.JSON(http.StatusBadRequest, gin.H{"message": "Can't find a webhook."})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{})
+	}
+}
+
+// Returns the delivery log of the webhooks, newest first. The "webhook"
+// query selects one webhook, "limit" (up to 200) and "before" (a
+// delivery ID) page through the log.
+func WebhookDeliveries(global bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		owner := webhookOwner(c, global)
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > 200 {
+			limit = 50
+		}
+		hooks := db.C.Model(&models.Webhook{}).Select("id").
+			Where("user_id = ?", owner)
+		if id := c.Query("webhook"); id != "" {
+			hookID, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				c.JSON(
+					http.StatusBadRequest,
+					gin.H{"message": "Webhook must be an ID."},
+				)
+				return
+			}
+			hooks = hooks.Where("id = ?", hookID)
+		}
+		query := db.C.Where("webhook_id IN (?)", hooks)
+		if before, err := strconv.ParseUint(c.Query("before"), 10, 64); err == nil {
+			query = query.Where("id < ?", before)
+		}
+		var deliveries []models.WebhookDelivery
+		dbReq := query.Order("id desc").Limit(limit).Find(&deliveries)
+		if dbReq.Error != nil {
+			log.Error(logging.F()+"() cannot find deliveries:", dbReq.Error)
+			c.JSON(
+				http.StatusBadRequest,
+				gin.H{"message": "Can't find deliveries."},
+			)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	}
+}
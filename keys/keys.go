@@ -0,0 +1,386 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"spa-api/logging"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt4 "github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Config
+
+// Signing algorithms of generated keys.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+var (
+	ErrUnknownKey       = errors.New("unknown signing key")
+	ErrUnknownAlgorithm = errors.New("unknown signing algorithm")
+	ErrNoSigningKey     = errors.New("no signing key")
+)
+
+// Signing key of webtokens. The key ID is the RFC 7638 thumbprint of
+// the public key.
+type Key struct {
+	ID        string
+	Algorithm string
+	Created   time.Time
+	Private   crypto.Signer
+	path      string
+}
+
+// Rotating set of signing keys stored as PEM files in a directory. A
+// new key is generated when the signing key is older than Rotation. It
+// is published in the JWKS at once, but signs tokens only after
+// Overlap, so other services can fetch it first. The previous key is
+// deleted when the tokens it signed have expired, Overlap after it
+// stopped signing. Overlap must be longer than the token lifetime.
+type Set struct {
+	Dir       string
+	Algorithm string        // of new keys
+	Rotation  time.Duration // 0 disables the rotation
+	Overlap   time.Duration
+
+	mu      sync.RWMutex
+	keys    []*Key // by creation time
+	signing *Key
+}
+
+// Loads the keys from the directory and rotates them. Legacy PKCS #1
+// "priv.pem" is loaded too, tokens without the kid header are verified
+// with it.
+func Load(dir, algorithm string, rotation, overlap time.Duration) (*Set, error) {
+	switch algorithm {
+	case RS256, ES256, EdDSA:
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+	s := &Set{
+		Dir:       dir,
+		Algorithm: algorithm,
+		Rotation:  rotation,
+		Overlap:   overlap,
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "key-*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "priv.pem")); err == nil {
+		paths = append(paths, filepath.Join(dir, "priv.pem"))
+	}
+	for _, path := range paths {
+		key, err := readKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		s.keys = append(s.keys, key)
+	}
+	return s, s.Rotate(time.Now())
+}
+
+// Runs the rotation in the background until the stop channel is
+// closed.
+func (s *Set) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := s.Rotate(now); err != nil {
+				log.Error(logging.F()+"() key rotation error:", err)
+			}
+		}
+	}
+}
+
+// Generates, activates and deletes keys according to the schedule.
+func (s *Set) Rotate(now time.Time) error {
+	// A RSA key takes seconds to generate, so it is done without the
+	// lock.
+	s.mu.RLock()
+	newest := len(s.keys) - 1
+	expired := newest < 0 ||
+		s.Rotation > 0 && now.Sub(s.keys[newest].Created) >= s.Rotation
+	s.mu.RUnlock()
+	var key *Key
+	if expired {
+		var err error
+		key, err = s.generate(now)
+		if err != nil {
+			return err
+		}
+		log.WithFields(logrus.Fields{
+			"kid": key.ID,
+			"alg": key.Algorithm,
+		}).Info(logging.F() + "() new signing key:")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key != nil {
+		s.keys = append(s.keys, key)
+	}
+	sort.Slice(s.keys, func(i, j int) bool {
+		return s.keys[i].Created.Before(s.keys[j].Created)
+	})
+	// The newest key that is published long enough, the first key signs
+	// at once.
+	signing := 0
+	for i, key := range s.keys {
+		if now.Sub(key.Created) >= s.Overlap {
+			signing = i
+		}
+	}
+	if s.signing != s.keys[signing] {
+		s.signing = s.keys[signing]
+		log.WithFields(logrus.Fields{
+			"kid": s.signing.ID,
+		}).Info(logging.F() + "() signing key activated:")
+	}
+	// Tokens of older keys expire Overlap after the next key started
+	// signing.
+	keep := []*Key{}
+	for i, key := range s.keys {
+		if i < signing && now.Sub(s.keys[i+1].Created) >= 2*s.Overlap {
+			log.WithFields(logrus.Fields{
+				"kid": key.ID,
+			}).Info(logging.F() + "() signing key retired:")
+			// Only generated keys are deleted, the legacy key file may be
+			// managed outside of the application.
+			if generated(key.path) {
+				if err := os.Remove(key.path); err != nil {
+					log.Error(logging.F()+"() cannot delete key:", err)
+				}
+			}
+			continue
+		}
+		keep = append(keep, key)
+	}
+	s.keys = keep
+	return nil
+}
+
+// Reports whether the key file was created by generate().
+func generated(path string) bool {
+	ok, _ := filepath.Match("key-*.pem", filepath.Base(path))
+	return ok
+}
+
+func (s *Set) generate(now time.Time) (*Key, error) {
+	var private crypto.Signer
+	var err error
+	switch s.Algorithm {
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, 4096)
+	case ES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(
+		s.Dir,
+		fmt.Sprintf("key-%d.pem", now.UnixNano()),
+	)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return newKey(private, now, path)
+}
+
+// Reads a PKCS #8 or PKCS #1 private key. The creation time of
+// generated keys is in the file name, of other keys it is the
+// modification time.
+func readKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	var private interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnknownAlgorithm
+	}
+	name := strings.TrimSuffix(filepath.Base(path), ".pem")
+	var created time.Time
+	if nano, err := strconv.ParseInt(strings.TrimPrefix(name, "key-"), 10, 64); err == nil {
+		created = time.Unix(0, nano)
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		created = info.ModTime()
+	}
+	return newKey(signer, created, path)
+}
+
+func newKey(private crypto.Signer, created time.Time, path string) (*Key, error) {
+	key := &Key{Created: created, Private: private, path: path}
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm = RS256
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, ErrUnknownAlgorithm
+		}
+		key.Algorithm = ES256
+	case ed25519.PrivateKey:
+		key.Algorithm = EdDSA
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+	jwk := key.JWK()
+	// RFC 7638: required members in lexicographic order.
+	var members []string
+	switch jwk["kty"] {
+	case "RSA":
+		members = []string{"e", "kty", "n"}
+	case "EC":
+		members = []string{"crv", "kty", "x", "y"}
+	case "OKP":
+		members = []string{"crv", "kty", "x"}
+	}
+	var thumbprint strings.Builder
+	thumbprint.WriteString("{")
+	for i, m := range members {
+		if i > 0 {
+			thumbprint.WriteString(",")
+		}
+		value, _ := json.Marshal(jwk[m])
+		fmt.Fprintf(&thumbprint, "%q:%s", m, value)
+	}
+	thumbprint.WriteString("}")
+	sum := sha256.Sum256([]byte(thumbprint.String()))
+	key.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return key, nil
+}
+
+// Returns the public key in the JSON Web Key format.
+func (k *Key) JWK() map[string]interface{} {
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwk := map[string]interface{}{
+		"alg": k.Algorithm,
+		"use": "sig",
+	}
+	if k.ID != "" {
+		jwk["kid"] = k.ID
+	}
+	switch pub := k.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = b64(pub.N.Bytes())
+		jwk["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = "P-256"
+		jwk["x"] = b64(pub.X.FillBytes(make([]byte, size)))
+		jwk["y"] = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = b64(pub)
+	}
+	return jwk
+}
+
+// Returns the published public keys as a JSON Web Key Set.
+func (s *Set) JWKS() map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]map[string]interface{}, 0, len(s.keys))
+	for _, key := range s.keys {
+		list = append(list, key.JWK())
+	}
+	return map[string]interface{}{"keys": list}
+}
+
+// Returns an error if the set has no key to sign tokens with.
+func (s *Set) Check() error {
+	if s == nil {
+		return ErrNoSigningKey
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.signing == nil || s.signing.Private == nil {
+		return ErrNoSigningKey
+	}
+	return nil
+}
+
+// Signs the claims with the current signing key.
+func (s *Set) Sign(claims jwt4.Claims) (string, error) {
+	s.mu.RLock()
+	key := s.signing
+	s.mu.RUnlock()
+	token := jwt4.NewWithClaims(jwt4.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Key function of the token parser. Returns the public key of the kid
+// header if the token algorithm matches the key.
+func (s *Set) KeyFunc(token *jwt4.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		legacy := kid == "" && filepath.Base(key.path) == "priv.pem"
+		if key.ID != kid && !legacy {
+			continue
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, ErrUnknownAlgorithm
+		}
+		return key.Private.Public(), nil
+	}
+	return nil, ErrUnknownKey
+}
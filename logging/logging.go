@@ -2,40 +2,77 @@ package logging
 
 import (
 	"context"
-	"os"
+	"errors"
+	"io"
+	"regexp"
 	"runtime"
+	"spa-api/config"
+	"spa-api/metrics"
+	"spa-api/tracing"
+	"strings"
 	"time"
 
-	_ "github.com/joho/godotenv/autoload"
 	"github.com/sirupsen/logrus"
-	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-var Config = Logger(os.Getenv("LOG_MODE"))
+var Config = Logger(config.Get().Log)
 
-// Logrus parameters
-func Logger(env string) *logrus.Logger {
+func init() {
+	config.OnReload(func(c *config.Config) {
+		configure(Config, c.Log)
+	})
+	config.OnLoad(func(c *config.Config) {
+		configure(Config, c.Log)
+	})
+}
+
+// Logrus parameters. Entries with a request context get its request
+// ID, secret fields are redacted and the entries are written to the
+// sinks of the settings.
+func Logger(c config.Log) *logrus.Logger {
 	log := logrus.New()
-	log.Formatter = &logrus.TextFormatter{
-		TimestampFormat: "2006-01-02 15:04:05",
-		FullTimestamp:   true,
-	}
-	level, err := logrus.ParseLevel(env)
-	if err != nil {
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
 		log.Fatal("Error parsing logging level:", err)
 	}
-	log.Level = level
-	logFile := &lumberjack.Logger{
-		Filename:   "logging/logs.log",
-		MaxSize:    16,
-		MaxBackups: 3,
-		Compress:   false,
-	}
-	log.Out = logFile
+	log.Out = io.Discard
+	configure(log, c)
 	return log
 }
 
+// Replaces the sinks of the logger. The logger level is the most
+// verbose sink level, so entries are created only if a sink writes
+// them.
+func configure(log *logrus.Logger, c config.Log) {
+	hooks := logrus.LevelHooks{}
+	hooks.Add(requestHook{})
+	hooks.Add(redactHook{})
+	var level logrus.Level
+	for _, s := range openSinks(c) {
+		hooks.Add(s)
+		if s.level > level {
+			level = s.level
+		}
+	}
+	log.ReplaceHooks(hooks)
+	log.SetLevel(level)
+}
+
+// Returns the JSON formatter with one object per line, or the text
+// formatter.
+func formatter(format string) logrus.Formatter {
+	if format == "json" {
+		return &logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		}
+	}
+	return &logrus.TextFormatter{
+		TimestampFormat: "2006-01-02 15:04:05",
+		FullTimestamp:   true,
+	}
+}
+
 // GORM-Logrus logger adapter
 func GL(logger *logrus.Logger) logger.Interface {
 	return &GormLogger{
@@ -75,25 +112,60 @@ func (l *GormLogger) Error(
 	l.logger.WithContext(ctx).Errorf("[GORM] "+msg, data...)
 }
 
+var unbound = regexp.MustCompile(`\$(\d+)\$`)
+
+// Drops the bound values of the statements, they may be secrets such as
+// password hashes and TOTP secrets. Statements are logged and traced
+// with their placeholders.
+func (l *GormLogger) ParamsFilter(
+	ctx context.Context,
+	sql string,
+	params ...interface{},
+) (string, []interface{}) {
+	return sql, nil
+}
+
 func (l *GormLogger) Trace(
 	ctx context.Context,
 	begin time.Time,
 	fc func() (string, int64),
 	err error,
 ) {
-	if l.logger.Level >= logrus.DebugLevel {
-		elapsed := time.Since(begin)
-		sql, rows := fc()
-		fields := logrus.Fields{
+	elapsed := time.Since(begin)
+	sql, rows := fc()
+	// Placeholders without values are marked as $1$ by GORM.
+	sql = unbound.ReplaceAllString(sql, "$$$1")
+	operation := sqlOperation(sql)
+	// A missing record is a result, not a failure of the database.
+	var failure error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		failure = err
+	}
+	metrics.Query(operation, elapsed, failure != nil)
+	tracing.Query(ctx, begin, operation, sql, rows, failure)
+	if l.logger.IsLevelEnabled(logrus.DebugLevel) {
+		entry := l.logger.WithContext(ctx).WithFields(logrus.Fields{
 			"rows":    rows,
 			"elapsed": elapsed,
-		}
+		})
 		if err != nil {
-			l.logger.WithFields(fields).WithError(err).Debug("[GORM] " + sql)
+			entry.WithError(err).Debug("[GORM] " + sql)
 		} else {
-			l.logger.WithFields(fields).Debug("[GORM] " + sql)
+			entry.Debug("[GORM] " + sql)
+		}
+	}
+}
+
+// Returns the first keyword of the SQL statement, SELECT, INSERT,
+// UPDATE, DELETE or OTHER.
+func sqlOperation(sql string) string {
+	if fields := strings.Fields(sql); len(fields) > 0 {
+		switch keyword := strings.ToUpper(fields[0]); keyword {
+		case "SELECT", "INSERT", "UPDATE", "DELETE":
+			return keyword
 		}
 	}
+	return "OTHER"
 }
 
 // Returns a string with the module, package, and function name that is
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+type requestIDKey struct{}
+
+// Returns the context with the ID of the request, added to the log
+// entries of the context.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// Returns the request ID of the context, empty if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Returns the log entry of the request context. Handlers log with it, so
+// every line of a request has its ID.
+func Ctx(ctx context.Context) *logrus.Entry {
+	return Config.WithContext(ctx)
+}
+
+// Adds the request ID of the entry context.
+type requestHook struct{}
+
+func (requestHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (requestHook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	if id := RequestID(entry.Context); id != "" {
+		entry.Data["request_id"] = id
+	}
+	return nil
+}
+
+// Value of the redacted fields.
+const Redacted = "[REDACTED]"
+
+// Parts of the names of fields with credentials.
+var secretFields = []string{
+	"password", "secret", "token", "authorization", "cookie",
+}
+
+// Replaces the values of fields with credentials, so passwords and
+// tokens do not reach the log file even if a handler logs them.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	for name := range entry.Data {
+		if secretField(name) {
+			entry.Data[name] = Redacted
+		}
+	}
+	return nil
+}
+
+func secretField(name string) bool {
+	name = strings.ToLower(name)
+	if name == "key" || name == "refresh" {
+		return true
+	}
+	for _, part := range secretFields {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"spa-api/config"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Destination of the log entries up to its level.
+type sink struct {
+	level     logrus.Level
+	formatter logrus.Formatter
+	write     func(level logrus.Level, line []byte) error
+}
+
+func (s *sink) Levels() []logrus.Level {
+	return logrus.AllLevels[:s.level+1]
+}
+
+func (s *sink) Fire(entry *logrus.Entry) error {
+	line, err := s.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	return s.write(entry.Level, line)
+}
+
+// Open file and syslog connection of the sinks, kept while their
+// settings do not change, so a reload does not reopen them.
+var opened struct {
+	mu         sync.Mutex
+	file       *lumberjack.Logger
+	syslog     io.Closer
+	syslogKey  string
+	syslogSend func(level logrus.Level, line []byte) error
+}
+
+// Returns the sinks of the settings. A syslog that cannot be reached is
+// reported on the standard error and skipped.
+func openSinks(c config.Log) []*sink {
+	opened.mu.Lock()
+	defer opened.mu.Unlock()
+	var sinks []*sink
+	if c.Console != "" {
+		out := os.Stdout
+		if c.Console == "stderr" {
+			out = os.Stderr
+		}
+		sinks = append(sinks, &sink{
+			level:     sinkLevel(c.ConsoleLevel, c.Level),
+			formatter: formatter(c.Format),
+			write:     writeTo(out),
+		})
+	}
+
+	file := opened.file
+	if file == nil ||
+		file.Filename != c.File ||
+		file.MaxSize != c.MaxSize ||
+		file.MaxBackups != c.MaxBackups ||
+		file.MaxAge != c.MaxAge ||
+		file.Compress != c.Compress {
+		if file != nil {
+			file.Close()
+		}
+		file = nil
+		if c.File != "" {
+			file = &lumberjack.Logger{
+				Filename:   c.File,
+				MaxSize:    c.MaxSize,
+				MaxBackups: c.MaxBackups,
+				MaxAge:     c.MaxAge,
+				Compress:   c.Compress,
+			}
+		}
+		opened.file = file
+	}
+	if file != nil {
+		sinks = append(sinks, &sink{
+			level:     sinkLevel(c.FileLevel, c.Level),
+			formatter: formatter(c.Format),
+			write:     writeTo(file),
+		})
+	}
+
+	key := c.Syslog + " " + c.SyslogTag
+	if key != opened.syslogKey {
+		if opened.syslog != nil {
+			opened.syslog.Close()
+		}
+		opened.syslog, opened.syslogSend, opened.syslogKey = nil, nil, ""
+		if c.Syslog == "" {
+			opened.syslogKey = key
+		} else {
+			// A failed dial is retried by the next configuration.
+			closer, send, err := dialSyslog(c.Syslog, c.SyslogTag)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error connecting to syslog:", err)
+			} else {
+				opened.syslog, opened.syslogSend = closer, send
+				opened.syslogKey = key
+			}
+		}
+	}
+	if opened.syslogSend != nil {
+		sinks = append(sinks, &sink{
+			level:     sinkLevel(c.SyslogLevel, c.Level),
+			formatter: syslogFormatter(c.Format),
+			write:     opened.syslogSend,
+		})
+	}
+	return sinks
+}
+
+// Returns the level of the sink, the default level if it is empty.
+// Levels are validated by the configuration.
+func sinkLevel(level, defaultLevel string) logrus.Level {
+	if level == "" {
+		level = defaultLevel
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return logrus.InfoLevel
+	}
+	return parsed
+}
+
+func writeTo(w io.Writer) func(logrus.Level, []byte) error {
+	return func(_ logrus.Level, line []byte) error {
+		_, err := w.Write(line)
+		return err
+	}
+}
+
+// Syslog adds the time, so the text lines have none.
+func syslogFormatter(format string) logrus.Formatter {
+	if format == "json" {
+		return formatter(format)
+	}
+	return &logrus.TextFormatter{
+		DisableTimestamp: true,
+		DisableColors:    true,
+	}
+}
@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Syslog is not available on this system.
+func dialSyslog(string, string) (io.Closer, func(logrus.Level, []byte) error, error) {
+	return nil, nil, errors.New("syslog is not supported on this system")
+}
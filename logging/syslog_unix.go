@@ -0,0 +1,54 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"io"
+	"log/syslog"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Connects to the local syslog socket, which is journald on systemd
+// hosts, or to the syslog URL. Returns the connection and the function
+// that sends a line with the severity of the level.
+func dialSyslog(
+	address, tag string,
+) (io.Closer, func(logrus.Level, []byte) error, error) {
+	var w *syslog.Writer
+	var err error
+	if address == "local" {
+		w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	} else {
+		var u *url.URL
+		u, err = url.Parse(address)
+		if err != nil {
+			return nil, nil, err
+		}
+		raddr := u.Host
+		if u.Scheme == "unix" || u.Scheme == "unixgram" {
+			raddr = u.Path
+		}
+		w, err = syslog.Dial(u.Scheme, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	send := func(level logrus.Level, line []byte) error {
+		message := string(line)
+		switch level {
+		case logrus.PanicLevel, logrus.FatalLevel:
+			return w.Crit(message)
+		case logrus.ErrorLevel:
+			return w.Err(message)
+		case logrus.WarnLevel:
+			return w.Warning(message)
+		case logrus.InfoLevel:
+			return w.Info(message)
+		default:
+			return w.Debug(message)
+		}
+	}
+	return w, send, nil
+}
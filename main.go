@@ -1,28 +1,103 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"spa-api/config"
 	db "spa-api/database"
+	"spa-api/events"
 	"spa-api/handlers"
 	"spa-api/logging"
+	"spa-api/metrics"
 	"spa-api/middleware"
 	"spa-api/models"
+	"spa-api/tracing"
+	"spa-api/webhooks"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/contrib/secure"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
 )
 
 var log = logging.Config
 
+// Usage: spa-api [dump] [flags]. The dump command prints the effective
+// configuration instead of running the server.
 func main() {
+	args := os.Args[1:]
+	dump := len(args) > 0 && args[0] == "dump"
+	if dump {
+		args = args[1:]
+	}
+	cfg, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(2)
+	}
+	if dump {
+		if err := config.Dump(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	config.Set(cfg)
+	gin.SetMode(cfg.Mode)
+	go config.Watch(cfg.File(), 5*time.Second, nil, func() { reload(args) })
+
+	// Tracing, the remaining spans are exported after the shutdown
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn(logging.F()+"() tracing error:", err)
+	}))
+	stopTracing, err := tracing.Init(cfg.Tracing)
+	if err != nil {
+		log.Fatal(logging.F()+"() cannot start tracing:", err)
+	}
+
 	// Database initial
 	db.Connect()
-	db.C.AutoMigrate(&models.User{}, &models.File{})
+	db.C.AutoMigrate(models.Tables()...)
+	handlers.CleanPartialUploads()
+	events.Handle(webhooks.Enqueue)
 
 	// Run router
-	r := router()
-	r.Run("127.0.0.1:8080")
+	serve(router(), internalRouter(), cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := stopTracing(ctx); err != nil {
+		log.Error(logging.F()+"() cannot export spans:", err)
+	}
+}
+
+// Applies the reloadable settings of the changed configuration file and
+// logs the changes.
+func reload(args []string) {
+	changes, err := config.Reload(args)
+	if err != nil {
+		log.Error(logging.F()+"() invalid configuration, nothing changed:", err)
+		return
+	}
+	for _, change := range changes {
+		fields := logrus.Fields{
+			"key": change.Key,
+			"old": change.Old,
+			"new": change.New,
+		}
+		if change.Applied {
+			log.WithFields(fields).Info(logging.F() + "() setting changed:")
+		} else {
+			log.WithFields(fields).Warn(logging.F() + "() setting requires a restart:")
+		}
+	}
 }
 
 func router() *gin.Engine {
@@ -31,26 +106,161 @@ func router() *gin.Engine {
 
 	// Gin settings
 	r := gin.New()
-	r.SetTrustedProxies([]string{"127.0.0.1"})
-	r.Use(gin.LoggerWithWriter(log.WriterLevel(logrus.InfoLevel)))
+	r.SetTrustedProxies(config.Get().Server.TrustedProxies)
+	probes := []string{"/livez", "/readyz", "/metrics"}
+	r.Use(middleware.RequestID())
+	r.Use(middleware.AccessLog(probes...))
+	r.Use(metrics.Middleware())
+	r.Use(tracing.Middleware(probes...))
 	r.Use(gin.RecoveryWithWriter(log.WriterLevel(logrus.ErrorLevel)))
+	authJWT := middleware.JWT()
+
+	// Probes, before the security middleware, because orchestrators
+	// connect by plain HTTP to the address of the instance
+	r.GET("/livez", handlers.Live)
+	r.GET("/readyz", handlers.Ready(authJWT.Keys))
+	if config.Get().Server.MetricsAddr == "" {
+		// Without the internal listener the metrics and the health
+		// details are for admins only, Prometheus authenticates with an
+		// API key.
+		internal := r.Group("", middleware.Auth(&authJWT)...)
+		internal.Use(middleware.Role(models.RoleAdmin))
+		internal.GET("/metrics", gin.WrapH(metrics.Handler()))
+		internal.GET("/healthz", handlers.Health(authJWT.Keys))
+	}
+
 	r.Use(secure.Secure(middleware.Security()))
 	r.Use(cors.New(middleware.CORS()))
-	authJWT := middleware.JWT()
-	r.MaxMultipartMemory = 8 << 20
+	r.MaxMultipartMemory = config.Get().Server.MaxMultipartMemory
+
+	r.GET("/.well-known/jwks.json", handlers.JWKS(authJWT.Keys))
+
+	// Rate limits per minute of the current configuration
+	loginLimit := func(l config.RateLimit) int { return l.Login }
+	refreshLimit := func(l config.RateLimit) int { return l.Refresh }
+	signUpLimit := func(l config.RateLimit) int { return l.SignUp }
+	mailLimit := func(l config.RateLimit) int { return l.Mail }
+	verifyLimit := func(l config.RateLimit) int { return l.Verify }
 
 	// Public routes
 	pub := r.Group("/api/pub")
-	pub.POST("/login", authJWT.LoginHandler)
-	pub.POST("/signup", handlers.SignUp)
+	pub.POST(
+		"/login",
+		middleware.RateLimit(loginLimit, time.Minute),
+		middleware.Backoff(),
+		authJWT.LoginHandler,
+	)
+	pub.POST(
+		"/signup",
+		middleware.RateLimit(signUpLimit, time.Minute),
+		handlers.SignUp,
+	)
+	pub.POST(
+		"/refresh",
+		middleware.RateLimit(refreshLimit, time.Minute),
+		handlers.Refresh(authJWT.TokenGenerator),
+	)
+	pub.POST(
+		"/password/forgot",
+		middleware.RateLimit(mailLimit, time.Minute),
+		handlers.RequestReset,
+	)
+	pub.POST(
+		"/password/reset",
+		middleware.RateLimit(mailLimit, time.Minute),
+		handlers.ResetPassword,
+	)
+	pub.POST(
+		"/verify",
+		middleware.RateLimit(verifyLimit, time.Minute),
+		handlers.VerifyEmail,
+	)
+	pub.GET("/oidc/login", handlers.OIDCLogin)
+	pub.GET(
+		"/oidc/callback",
+		middleware.RateLimit(loginLimit, time.Minute),
+		handlers.OIDCCallback(authJWT.TokenGenerator),
+	)
+	pub.POST(
+		"/oidc/verify",
+		middleware.RateLimit(loginLimit, time.Minute),
+		middleware.Backoff(),
+		handlers.OIDCVerify(authJWT.TokenGenerator),
+	)
 
 	// Authenticated routes
 	auth := r.Group("/api/auth")
-	auth.Use(authJWT.MiddlewareFunc())
-	auth.GET("/files", handlers.List)
-	auth.GET("/download", handlers.Download)
-	auth.POST("/upload", handlers.Upload)
-	auth.POST("/rename", handlers.Rename)
-	auth.POST("/delete", handlers.Delete)
+	auth.Use(middleware.Auth(&authJWT)...)
+	auth.GET("/files", middleware.Scope(models.ScopeRead), handlers.List)
+	auth.GET("/download", middleware.Scope(models.ScopeRead), handlers.Download)
+	auth.GET("/events", middleware.Scope(models.ScopeRead), handlers.Events)
+	auth.POST(
+		"/upload",
+		middleware.Scope(models.ScopeUpload),
+		middleware.Role(models.RoleAdmin, models.RoleUser),
+		handlers.Upload,
+	)
+
+	// Authenticated routes of the full scope
+	full := auth.Group("", middleware.Scope(models.ScopeFull))
+	write := full.Group("", middleware.Role(models.RoleAdmin, models.RoleUser))
+	write.POST("/rename", handlers.Rename)
+	write.POST("/delete", handlers.Delete)
+	full.POST("/logout", handlers.LogOut)
+	full.GET("/activity", handlers.Activity)
+	full.GET("/keys", handlers.APIKeys)
+	full.POST(
+		"/verify/resend",
+		middleware.RateLimit(mailLimit, time.Minute),
+		handlers.ResendVerification,
+	)
+	// Credential and session management routes of interactive sessions
+	session := full.Group("", middleware.Interactive())
+	session.POST("/logout/all", handlers.LogOutAll)
+	session.GET("/sessions", handlers.Sessions)
+	session.POST("/sessions/revoke", handlers.RevokeSession)
+	session.POST("/totp/enroll", handlers.TOTPEnroll)
+	session.POST("/totp/confirm", handlers.TOTPConfirm)
+	session.POST("/totp/disable", handlers.TOTPDisable)
+	session.POST("/keys/create", handlers.CreateAPIKey)
+	session.POST("/keys/revoke", handlers.RevokeAPIKey)
+	session.GET("/oidc/link", handlers.OIDCLink)
+	session.POST("/password", handlers.ChangePassword)
+	session.POST("/account/delete", handlers.DeleteAccount)
+	session.GET("/webhooks", handlers.Webhooks(false))
+	session.POST("/webhooks/create", handlers.CreateWebhook(false))
+	session.POST("/webhooks/delete", handlers.DeleteWebhook(false))
+	session.GET("/webhooks/deliveries", handlers.WebhookDeliveries(false))
+
+	// Administration routes
+	admin := r.Group("/api/admin")
+	admin.Use(middleware.Auth(&authJWT)...)
+	admin.Use(
+		middleware.Scope(models.ScopeFull),
+		middleware.Role(models.RoleAdmin),
+	)
+	admin.GET("/users", handlers.AdminUsers)
+	admin.GET("/usage", handlers.AdminUsage)
+	admin.GET("/audit/export", handlers.AuditExport)
+	admin.POST("/users/disable", handlers.DisableUser)
+	admin.POST("/users/enable", handlers.EnableUser)
+	admin.POST("/users/role", handlers.SetRole)
+	admin.POST("/users/quota", handlers.SetQuota)
+	admin.POST("/users/quota/reset", handlers.ResetQuota)
+	admin.GET("/webhooks", handlers.Webhooks(true))
+	admin.POST("/webhooks/create", handlers.CreateWebhook(true))
+	admin.POST("/webhooks/delete", handlers.DeleteWebhook(true))
+	admin.GET("/webhooks/deliveries", handlers.WebhookDeliveries(true))
+	return r
+}
+
+// Router of the internal listener: metrics and health details for
+// operators, without authentication.
+func internalRouter() *gin.Engine {
+	middleware.Keys()
+	r := gin.New()
+	r.Use(gin.RecoveryWithWriter(log.WriterLevel(logrus.ErrorLevel)))
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	r.GET("/healthz", handlers.Health(middleware.JWT().Keys))
 	return r
 }
@@ -1,22 +1,61 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"spa-api/certs"
+	"spa-api/config"
 	db "spa-api/database"
+	"spa-api/events"
+	"spa-api/handlers"
+	"spa-api/keys"
+	"spa-api/logging"
+	"spa-api/metrics"
 	"spa-api/middleware"
 	"spa-api/models"
+	"spa-api/notify"
+	"spa-api/passwords"
+	"spa-api/tracing"
+	"spa-api/webhooks"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	jwt4 "github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -28,6 +67,48 @@ import (
     возможных тестовых случаев.
 */
 
+// Returns a JSON request of the data to the test router. The webtoken
+// is sent if it is not empty.
+func newRequest(
+	t *testing.T,
+	method, url, token string,
+	data interface{},
+) *http.Request {
+	jsonData, err := json.Marshal(data)
+	assert.NoError(t, err)
+	request, err := http.NewRequest(
+		method,
+		"http://127.0.0.1:8080"+url,
+		bytes.NewBuffer(jsonData),
+	)
+	assert.NoError(t, err)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+// Serves the request by the router. Returns the status code and the
+// decoded JSON response.
+func record(r http.Handler, request *http.Request) (int, gin.H) {
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	var result gin.H
+	json.Unmarshal(response.Body.Bytes(), &result)
+	return response.Code, result
+}
+
+// Sends a JSON request of the data to the router.
+func send(
+	t *testing.T,
+	r http.Handler,
+	method, url, token string,
+	data interface{},
+) (int, gin.H) {
+	return record(r, newRequest(t, method, url, token, data))
+}
+
 // Testing for inbound data in the handlers.SignUp() function.
 func TestSignUp(t *testing.T) {
 	type args struct {
@@ -131,11 +212,8 @@ func TestSignUp(t *testing.T) {
 			// Setup test database
 			gin.SetMode(gin.TestMode)
 			db.Connect()
-			db.C.AutoMigrate(&models.User{}, &models.File{})
-			defer db.C.Migrator().DropTable(
-				&models.User{},
-				&models.File{},
-			)
+			db.C.AutoMigrate(models.Tables()...)
+			defer db.C.Migrator().DropTable(models.Tables()...)
 
 			// Create testing data
 			send := models.User{
@@ -166,11 +244,13 @@ func TestSignUp(t *testing.T) {
 				assert.Equal(t, http.StatusOK, response.Code)
 				assert.NoError(t, dbReq.Error)
 				assert.NotEqual(t, send.Password, entry.Password)
-				err := bcrypt.CompareHashAndPassword(
-					[]byte(entry.Password),
-					[]byte(send.Password),
+				assert.True(t, strings.HasPrefix(entry.Password, "$argon2id$"))
+				ok, rehash := handlers.PasswordHasher.Verify(
+					entry.Password,
+					send.Password,
 				)
-				assert.NoError(t, err)
+				assert.True(t, ok)
+				assert.False(t, rehash)
 			} else {
 				assert.NotEqual(t, http.StatusOK, response.Code)
 				assert.Error(t, dbReq.Error)
@@ -234,11 +314,8 @@ func TestLogIn(t *testing.T) {
 			// Setup test database
 			gin.SetMode(gin.TestMode)
 			db.Connect()
-			db.C.AutoMigrate(&models.User{}, &models.File{})
-			defer db.C.Migrator().DropTable(
-				&models.User{},
-				&models.File{},
-			)
+			db.C.AutoMigrate(models.Tables()...)
+			defer db.C.Migrator().DropTable(models.Tables()...)
 			hashedPass, err := bcrypt.GenerateFromPassword(
 				[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
 			)
@@ -358,11 +435,8 @@ func TestAuth(t *testing.T) {
 			// Setup test database
 			gin.SetMode(gin.TestMode)
 			db.Connect()
-			db.C.AutoMigrate(&models.User{}, &models.File{})
-			defer db.C.Migrator().DropTable(
-				&models.User{},
-				&models.File{},
-			)
+			db.C.AutoMigrate(models.Tables()...)
+			defer db.C.Migrator().DropTable(models.Tables()...)
 
 			// Setup router
 			r := router()
@@ -430,11 +504,8 @@ func TestList(t *testing.T) {
 			// Setup test database
 			gin.SetMode(gin.TestMode)
 			db.Connect()
-			db.C.AutoMigrate(&models.User{}, &models.File{})
-			defer db.C.Migrator().DropTable(
-				&models.User{},
-				&models.File{},
-			)
+			db.C.AutoMigrate(models.Tables()...)
+			defer db.C.Migrator().DropTable(models.Tables()...)
 
 			// Create testing data
 			db.C.Create(&tt.args.user)
@@ -478,11 +549,8 @@ func TestDownload(t *testing.T) {
 	// Setup test database
 	gin.SetMode(gin.TestMode)
 	db.Connect()
-	db.C.AutoMigrate(&models.User{}, &models.File{})
-	defer db.C.Migrator().DropTable(
-		&models.User{},
-		&models.File{},
-	)
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
 	user := models.User{
 		Username: "testuser",
 		Password: "testpassword",
@@ -529,11 +597,8 @@ func TestUpload(t *testing.T) {
 	// Setup test database
 	gin.SetMode(gin.TestMode)
 	db.Connect()
-	db.C.AutoMigrate(&models.User{}, &models.File{})
-	defer db.C.Migrator().DropTable(
-		&models.User{},
-		&models.File{},
-	)
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
 	user := models.User{
 		Username: "testuser",
 		Password: "testpassword",
@@ -574,6 +639,7 @@ func TestUpload(t *testing.T) {
 	assert.NoError(t, err)
 	source, err := os.ReadFile("upload/test.file")
 	assert.NoError(t, err)
+	_, partialErr := os.Stat("upload/test/1/test.file.part")
 	err = os.RemoveAll("upload/test/1/")
 	assert.NoError(t, err)
 	var entry models.File
@@ -582,6 +648,7 @@ func TestUpload(t *testing.T) {
 	// Estimation of values
 	assert.Equal(t, http.StatusOK, response.Code)
 	assert.Equal(t, source, loaded)
+	assert.True(t, os.IsNotExist(partialErr))
 	assert.NoError(t, dbReq.Error)
 	assert.Equal(t, "/1/test.file", entry.Name)
 	assert.Equal(t, "test", entry.ListName)
@@ -594,11 +661,8 @@ func TestRename(t *testing.T) {
 	// Setup test database
 	gin.SetMode(gin.TestMode)
 	db.Connect()
-	db.C.AutoMigrate(&models.User{}, &models.File{})
-	defer db.C.Migrator().DropTable(
-		&models.User{},
-		&models.File{},
-	)
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
 	user := models.User{
 		Username: "testuser",
 		Password: "testpassword",
@@ -657,11 +721,8 @@ func TestDelete(t *testing.T) {
 	// Setup test database
 	gin.SetMode(gin.TestMode)
 	db.Connect()
-	db.C.AutoMigrate(&models.User{}, &models.File{})
-	defer db.C.Migrator().DropTable(
-		&models.User{},
-		&models.File{},
-	)
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
 	user := models.User{
 		Username: "testuser",
 		Password: "testpassword",
@@ -725,3 +786,2365 @@ func TestDelete(t *testing.T) {
 	err = os.RemoveAll("upload/test/1/")
 	assert.NoError(t, err)
 }
+
+// Testing the account lockout after failed logins in the
+// handlers.LogIn() function.
+func TestLockout(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	user := models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	}
+	db.C.Create(&user)
+	maxFailed := handlers.MaxFailedLogins
+	handlers.MaxFailedLogins = 2
+	defer func() { handlers.MaxFailedLogins = maxFailed }()
+
+	// Setup router
+	r := router()
+	login := func(password string) int {
+		code, _ := send(t, r, "POST", "/api/pub/login", "", models.User{
+			Username: "testuser",
+			Password: password,
+		})
+		return code
+	}
+
+	// Estimation of values
+	assert.Equal(t, http.StatusUnauthorized, login("wrongpassword"))
+	assert.Equal(t, http.StatusUnauthorized, login("wrongpassword"))
+	assert.Equal(t, http.StatusUnauthorized, login("abcdEFGH1234!@#$"))
+	var entry models.User
+	dbReq := db.C.First(&entry, user.ID)
+	assert.NoError(t, dbReq.Error)
+	assert.True(t, entry.LockedUntil.After(time.Now()))
+	var lockouts []models.Lockout
+	db.C.Where("user_id = ?", user.ID).Find(&lockouts)
+	assert.Len(t, lockouts, 1)
+}
+
+// Testing the exponential backoff of repeated failed logins in the
+// middleware.Backoff() function.
+func TestBackoff(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+
+	// Setup router
+	r := router()
+	codes := []int{}
+	for i := 0; i < 5; i++ {
+		code, _ := send(t, r, "POST", "/api/pub/login", "", models.User{
+			Username: "someuser",
+			Password: "wrongpassword",
+		})
+		codes = append(codes, code)
+	}
+
+	// Estimation of values
+	assert.Equal(t, []int{401, 401, 401, 401, 429}, codes)
+}
+
+// Testing the two-factor enrollment and the second login step in the
+// handlers.TOTPEnroll(), handlers.TOTPConfirm() and handlers.LogIn()
+// functions.
+func TestTOTP(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	user := models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	}
+	db.C.Create(&user)
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	token, _, _ := authJWT.TokenGenerator(&models.User{
+		ID: user.ID,
+	})
+
+	// Enroll and confirm
+	code, result := send(t, r, "POST", "/api/auth/totp/enroll", token, gin.H{})
+	assert.Equal(t, http.StatusOK, code)
+	secret, _ := result["secret"].(string)
+	assert.NotEmpty(t, secret)
+	assert.Contains(t, result["uri"], "otpauth://totp/")
+	totp, err := handlers.TOTPCode(secret, time.Now())
+	assert.NoError(t, err)
+	code, result = send(t, r, "POST", "/api/auth/totp/confirm", token, gin.H{"code": totp})
+	assert.Equal(t, http.StatusOK, code)
+	recovery, _ := result["codes"].([]interface{})
+	assert.Len(t, recovery, 10)
+
+	// Estimation of values
+	login := gin.H{"username": "testuser", "password": "abcdEFGH1234!@#$"}
+	code, result = send(t, r, "POST", "/api/pub/login", "", login)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, handlers.ErrTOTPRequired.Error(), result["message"])
+	// Requests for the code are not failures for the login backoff
+	for i := 0; i < 5; i++ {
+		code, _ = send(t, r, "POST", "/api/pub/login", "", login)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+	login["code"] = totp
+	code, _ = send(t, r, "POST", "/api/pub/login", "", login)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	login["code"] = recovery[0]
+	code, result = send(t, r, "POST", "/api/pub/login", "", login)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, result["token"])
+	code, _ = send(t, r, "POST", "/api/pub/login", "", login)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// Testing the refresh token rotation in the handlers.Refresh()
+// function.
+func TestRefresh(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	db.C.Create(&models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	})
+
+	// Setup router
+	r := router()
+
+	// Estimation of values
+	code, result := send(t, r, "POST", "/api/pub/login", "", gin.H{
+		"username": "testuser",
+		"password": "abcdEFGH1234!@#$",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	first, _ := result["refresh"].(string)
+	assert.NotEmpty(t, first)
+	code, result = send(t, r, "POST", "/api/pub/refresh", "", gin.H{"refresh": first})
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, result["token"])
+	second, _ := result["refresh"].(string)
+	assert.NotEmpty(t, second)
+	assert.NotEqual(t, first, second)
+	code, _ = send(t, r, "POST", "/api/pub/refresh", "", gin.H{"refresh": first})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = send(t, r, "POST", "/api/pub/refresh", "", gin.H{"refresh": second})
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// Testing the access token revocation in the handlers.LogOut(),
+// handlers.LogOutAll() and middleware.Revocation() functions.
+func TestLogOut(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	status := func(method, url, token string) int {
+		code, _ := send(t, r, method, url, token, nil)
+		return code
+	}
+	first, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	second, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+
+	// Estimation of values
+	assert.Equal(t, http.StatusOK, status("GET", "/api/auth/files", first))
+	assert.Equal(t, http.StatusOK, status("POST", "/api/auth/logout", first))
+	assert.Equal(t, http.StatusUnauthorized, status("GET", "/api/auth/files", first))
+	assert.Equal(t, http.StatusOK, status("GET", "/api/auth/files", second))
+	assert.Equal(t, http.StatusOK, status("POST", "/api/auth/logout/all", second))
+	assert.Equal(t, http.StatusUnauthorized, status("GET", "/api/auth/files", second))
+	third, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	assert.Equal(t, http.StatusOK, status("GET", "/api/auth/files", third))
+}
+
+// Testing the session list and revocation in the handlers.Sessions()
+// and handlers.RevokeSession() functions.
+func TestSessions(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	db.C.Create(&models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	})
+
+	// Setup router
+	r := router()
+	login := gin.H{"username": "testuser", "password": "abcdEFGH1234!@#$"}
+	_, first := send(t, r, "POST", "/api/pub/login", "", login)
+	_, second := send(t, r, "POST", "/api/pub/login", "", login)
+	firstToken, _ := first["token"].(string)
+	secondToken, _ := second["token"].(string)
+
+	// Estimation of values
+	code, result := send(t, r, "GET", "/api/auth/sessions", firstToken, nil)
+	assert.Equal(t, http.StatusOK, code)
+	sessions, _ := result["sessions"].([]interface{})
+	assert.Len(t, sessions, 2)
+	var other float64
+	for _, v := range sessions {
+		session := v.(map[string]interface{})
+		if session["Current"] != true {
+			other = session["ID"].(float64)
+		}
+	}
+	assert.NotZero(t, other)
+	code, _ = send(t, r, "POST", "/api/auth/sessions/revoke", firstToken, gin.H{
+		"id": other,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "GET", "/api/auth/files", secondToken, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = send(t, r, "POST", "/api/pub/refresh", "", gin.H{
+		"refresh": second["refresh"],
+	})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = send(t, r, "GET", "/api/auth/files", firstToken, nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+// Testing personal API keys and their scopes in the
+// handlers.CreateAPIKey(), handlers.RevokeAPIKey() and
+// middleware.APIKey() functions.
+func TestAPIKeys(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	token, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	code, result := send(t, r, "POST", "/api/auth/keys/create", token, gin.H{
+		"name":  "backup script",
+		"scope": models.ScopeRead,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	key, _ := result["key"].(string)
+	assert.True(t, strings.HasPrefix(key, handlers.APIKeyPrefix))
+
+	// Estimation of values
+	code, _ = send(t, r, "GET", "/api/auth/files", key, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "POST", "/api/auth/rename", key, gin.H{"id": 1})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/keys/create", key, gin.H{
+		"name":  "escalation",
+		"scope": models.ScopeFull,
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, created := send(t, r, "POST", "/api/auth/keys/create", token, gin.H{
+		"name":  "sync script",
+		"scope": models.ScopeFull,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	full, _ := created["key"].(string)
+	code, _ = send(t, r, "GET", "/api/auth/activity", full, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "GET", "/api/auth/sessions", full, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/logout/all", full, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/keys/create", full, gin.H{
+		"name":  "escalation",
+		"scope": models.ScopeFull,
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/password", full, gin.H{
+		"password":    "testpassword",
+		"newPassword": "Another-Passw0rd!",
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/totp/enroll", full, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/account/delete", full, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "GET", "/api/auth/files", key+"0", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = send(t, r, "POST", "/api/auth/keys/revoke", token, gin.H{
+		"id": result["ID"],
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "GET", "/api/auth/files", key, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// Testing the OpenID Connect login against a mock identity provider in
+// the handlers.OIDCLogin() and handlers.OIDCCallback() functions.
+func TestOIDC(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+
+	// Setup mock identity provider
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	var challenge, nonce string
+	mux := http.NewServeMux()
+	idp := httptest.NewServer(mux)
+	defer idp.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(gin.H{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(gin.H{"keys": []gin.H{{
+			"kid": "test",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "testcode" ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(gin.H{"error": "invalid_grant"})
+			return
+		}
+		token := jwt4.NewWithClaims(jwt4.SigningMethodRS256, jwt4.MapClaims{
+			"iss":                idp.URL,
+			"aud":                "spa",
+			"sub":                "subject-1",
+			"nonce":              nonce,
+			"exp":                time.Now().Add(time.Minute).Unix(),
+			"preferred_username": "jdoe",
+		})
+		token.Header["kid"] = "test"
+		signed, err := token.SignedString(key)
+		assert.NoError(t, err)
+		json.NewEncoder(w).Encode(gin.H{"id_token": signed})
+	})
+	config := handlers.OIDC
+	handlers.OIDC = handlers.OIDCConfig{
+		Issuer:       idp.URL,
+		ClientID:     "spa",
+		ClientSecret: "secret",
+		RedirectURL:  "http://127.0.0.1:8080/api/pub/oidc/callback",
+	}
+	defer func() { handlers.OIDC = config }()
+
+	// Setup router
+	r := router()
+	bound := true
+	login := func() (int, gin.H) {
+		request, err := http.NewRequest(
+			"GET",
+			"http://127.0.0.1:8080/api/pub/oidc/login",
+			nil,
+		)
+		assert.NoError(t, err)
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		assert.Equal(t, http.StatusFound, response.Code)
+		location, err := url.Parse(response.Header().Get("Location"))
+		assert.NoError(t, err)
+		challenge = location.Query().Get("code_challenge")
+		nonce = location.Query().Get("nonce")
+		cookies := response.Result().Cookies()
+		assert.NotEmpty(t, cookies)
+		request, err = http.NewRequest(
+			"GET",
+			"http://127.0.0.1:8080/api/pub/oidc/callback?code=testcode&state="+
+				location.Query().Get("state"),
+			nil,
+		)
+		assert.NoError(t, err)
+		if bound {
+			for _, cookie := range cookies {
+				request.AddCookie(cookie)
+			}
+		}
+		response = httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		var result gin.H
+		json.Unmarshal(response.Body.Bytes(), &result)
+		return response.Code, result
+	}
+
+	// Estimation of values
+	code, result := login()
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, result["token"])
+
+	// Callbacks from another client without the state cookie are rejected
+	bound = false
+	code, result = login()
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Nil(t, result["token"])
+	bound = true
+	code, _ = login()
+	assert.Equal(t, http.StatusOK, code)
+	var users []models.User
+	db.C.Find(&users)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "jdoe", users[0].Username)
+	var logins []models.AuditEvent
+	db.C.Where("action = ?", models.ActionLogin).Find(&logins)
+	assert.Len(t, logins, 2)
+	for _, entry := range logins {
+		assert.Equal(t, users[0].ID, entry.ActorID)
+		assert.Equal(t, models.OutcomeSuccess, entry.Outcome)
+	}
+
+	// Users with two-factor authentication log in with a ticket and a code
+	db.C.Model(&users[0]).Updates(map[string]interface{}{
+		"totp_secret":  "JBSWY3DPEHPK3PXP",
+		"totp_enabled": true,
+	})
+	code, result = login()
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, handlers.ErrTOTPRequired.Error(), result["message"])
+	assert.Nil(t, result["token"])
+	ticket, _ := result["ticket"].(string)
+	assert.NotEmpty(t, ticket)
+	code, _ = send(t, r, "POST", "/api/pub/oidc/verify", "", gin.H{
+		"ticket": ticket,
+		"code":   "000000",
+	})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	db.C.First(&users[0], users[0].ID)
+	assert.Equal(t, 1, users[0].FailedLogins)
+	totp, err := handlers.TOTPCode("JBSWY3DPEHPK3PXP", time.Now())
+	assert.NoError(t, err)
+	code, _ = send(t, r, "POST", "/api/pub/oidc/verify", "", gin.H{
+		"ticket": ticket,
+		"code":   totp,
+	})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	_, result = login()
+	ticket, _ = result["ticket"].(string)
+	code, result = send(t, r, "POST", "/api/pub/oidc/verify", "", gin.H{
+		"ticket": ticket,
+		"code":   totp,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, result["token"])
+
+	// Locked accounts cannot log in with the provider
+	db.C.Model(&users[0]).Update("locked_until", time.Now().Add(time.Hour))
+	code, result = login()
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, handlers.ErrAccountLocked.Error(), result["message"])
+}
+
+// Entry of the in-process LDAP server.
+type ldapUser struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// Starts an in-process LDAP server that supports simple bind and search
+// by an equality filter. Return the server URL.
+func ldapServer(t *testing.T, users map[string]ldapUser) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	reply := func(conn net.Conn, id int64, op *ber.Packet) {
+		packet := ber.Encode(
+			ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "",
+		)
+		packet.AppendChild(ber.NewInteger(
+			ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "",
+		))
+		packet.AppendChild(op)
+		conn.Write(packet.Bytes())
+	}
+	result := func(tag ber.Tag, code int64) *ber.Packet {
+		op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+		op.AppendChild(ber.NewInteger(
+			ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "",
+		))
+		op.AppendChild(ber.NewString(
+			ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "",
+		))
+		op.AppendChild(ber.NewString(
+			ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "",
+		))
+		return op
+	}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			packet, err := ber.ReadPacket(conn)
+			if err != nil || len(packet.Children) < 2 {
+				return
+			}
+			id, _ := packet.Children[0].Value.(int64)
+			op := packet.Children[1]
+			switch op.Tag {
+			case 0: // bind
+				dn := op.Children[1].Data.String()
+				password := op.Children[2].Data.String()
+				code := int64(49) // invalid credentials
+				for _, user := range users {
+					if user.dn == dn && user.password == password {
+						code = 0
+					}
+				}
+				reply(conn, id, result(1, code))
+			case 3: // search
+				name := op.Children[6].Children[1].Data.String()
+				if user, ok := users[name]; ok {
+					entry := ber.Encode(
+						ber.ClassApplication, ber.TypeConstructed, 4, nil, "",
+					)
+					entry.AppendChild(ber.NewString(
+						ber.ClassUniversal, ber.TypePrimitive,
+						ber.TagOctetString, user.dn, "",
+					))
+					attrs := ber.NewSequence("")
+					attr := ber.NewSequence("")
+					attr.AppendChild(ber.NewString(
+						ber.ClassUniversal, ber.TypePrimitive,
+						ber.TagOctetString, "memberOf", "",
+					))
+					vals := ber.Encode(
+						ber.ClassUniversal, ber.TypeConstructed,
+						ber.TagSet, nil, "",
+					)
+					for _, group := range user.groups {
+						vals.AppendChild(ber.NewString(
+							ber.ClassUniversal, ber.TypePrimitive,
+							ber.TagOctetString, group, "",
+						))
+					}
+					attr.AppendChild(vals)
+					attrs.AppendChild(attr)
+					entry.AppendChild(attrs)
+					reply(conn, id, entry)
+				}
+				reply(conn, id, result(5, 0))
+			default: // unbind
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+// Testing the LDAP authentication provider against an in-process LDAP
+// server in the handlers.LogIn() function.
+func TestLDAP(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+
+	// Setup directory
+	ldapURL := ldapServer(t, map[string]ldapUser{
+		"jdoe": {
+			dn:       "uid=jdoe,ou=people,dc=example,dc=com",
+			password: "directoryPassword",
+			groups:   []string{"cn=Admins,ou=groups,dc=example,dc=com"},
+		},
+	})
+	config, providers, disabled := *handlers.LDAP, handlers.Providers,
+		handlers.SignUpDisabled
+	defer func() {
+		*handlers.LDAP = config
+		handlers.Providers, handlers.SignUpDisabled = providers, disabled
+	}()
+	*handlers.LDAP = handlers.LDAPProvider{
+		URL:        ldapURL,
+		BaseDN:     "dc=example,dc=com",
+		UserFilter: "(uid=%s)",
+		GroupAttr:  "memberOf",
+		GroupRoles: handlers.ParseGroupRoles(
+			"cn=admins,ou=groups,dc=example,dc=com:admin",
+		),
+	}
+	handlers.Providers = []handlers.Authenticator{handlers.Local{}, handlers.LDAP}
+	handlers.SignUpDisabled = true
+
+	// Setup router
+	r := router()
+	post := func(url string, data interface{}) int {
+		code, _ := send(t, r, "POST", url, "", data)
+		return code
+	}
+
+	// Estimation of values
+	assert.Equal(t, http.StatusUnauthorized, post("/api/pub/login", gin.H{
+		"username": "jdoe",
+		"password": "wrongpassword",
+	}))
+	assert.Equal(t, http.StatusOK, post("/api/pub/login", gin.H{
+		"username": "jdoe",
+		"password": "directoryPassword",
+	}))
+	var entry models.User
+	dbReq := db.C.Where("username = ?", "jdoe").First(&entry)
+	assert.NoError(t, dbReq.Error)
+	assert.Equal(t, models.ProviderLDAP, entry.Provider)
+	assert.Equal(t, "admin", entry.Role)
+	assert.Equal(t, http.StatusForbidden, post("/api/pub/signup", gin.H{
+		"username": "newuser",
+		"password": "abcdEFGH1234!@#$",
+	}))
+}
+
+// Testing roles and the administration routes in the
+// middleware.Role(), handlers.DisableUser(), handlers.SetRole() and
+// handlers.SetQuota() functions.
+func TestAdmin(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	admin := models.User{
+		Username: "testadmin",
+		Password: "testpassword",
+		Role:     models.RoleAdmin,
+	}
+	db.C.Create(&admin)
+	demoted := models.User{
+		Username: "testdemoted",
+		Password: "testpassword",
+		Role:     models.RoleAdmin,
+	}
+	db.C.Create(&demoted)
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+	db.C.Create(&models.File{
+		UserID:    user.ID,
+		ListName:  "test",
+		Name:      "/2/test.file",
+		Extension: ".file",
+		Path:      "upload/test/2/test.file",
+		Date:      time.Now(),
+		Size:      100,
+	})
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	adminToken, _, _ := authJWT.TokenGenerator(&models.User{ID: admin.ID})
+	userToken, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	demotedToken, _, _ := authJWT.TokenGenerator(&models.User{ID: demoted.ID})
+	upload := func(token string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("files", "test.file")
+		assert.NoError(t, err)
+		part.Write([]byte("0123456789"))
+		writer.Close()
+		request, err := http.NewRequest(
+			"POST",
+			"http://127.0.0.1:8080/api/auth/upload",
+			body,
+		)
+		assert.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// Estimation of values
+	code, _ := send(t, r, "GET", "/api/admin/users", userToken, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, result := send(t, r, "GET", "/api/admin/users", adminToken, nil)
+	assert.Equal(t, http.StatusOK, code)
+	users, _ := result["users"].([]interface{})
+	assert.Len(t, users, 3)
+	code, result = send(
+		t, r, "GET", fmt.Sprintf("/api/admin/usage?id=%d", user.ID), adminToken, nil,
+	)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(1), result["Files"])
+	assert.Equal(t, float64(100), result["Usage"])
+	code, _ = send(t, r, "POST", "/api/admin/users/quota", adminToken, gin.H{
+		"id": user.ID, "quota": 105,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, upload(userToken))
+	code, _ = send(t, r, "POST", "/api/admin/users/role", adminToken, gin.H{
+		"id": user.ID, "role": models.RoleReadOnly,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "GET", "/api/admin/users", demotedToken, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "POST", "/api/admin/users/role", adminToken, gin.H{
+		"id": demoted.ID, "role": models.RoleUser,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "GET", "/api/admin/users", demotedToken, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	demotedToken, _, _ = authJWT.TokenGenerator(&models.User{ID: demoted.ID})
+	code, _ = send(t, r, "GET", "/api/admin/users", demotedToken, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	readOnlyToken, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	assert.Equal(t, http.StatusForbidden, upload(readOnlyToken))
+	code, _ = send(t, r, "GET", "/api/auth/files", readOnlyToken, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "POST", "/api/admin/users/disable", adminToken, gin.H{
+		"id": admin.ID,
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(t, r, "POST", "/api/admin/users/disable", adminToken, gin.H{
+		"id": user.ID,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "GET", "/api/auth/files", readOnlyToken, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = send(t, r, "POST", "/api/pub/login", "", gin.H{
+		"username": "testuser", "password": "testpassword",
+	})
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = send(t, r, "POST", "/api/admin/users/enable", adminToken, gin.H{
+		"id": user.ID,
+	})
+	assert.Equal(t, http.StatusOK, code)
+}
+
+// Testing the password change and the reset by a mailed link in the
+// handlers.ChangePassword(), handlers.RequestReset() and
+// handlers.ResetPassword() functions.
+func TestPassword(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	db.C.Create(&models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	})
+	mailer := &notify.Fake{}
+	handlers.Mailer = mailer
+	handlers.MailDomain = "example.com"
+
+	// Setup router
+	r := router()
+	login := func(password string) (int, string) {
+		code, result := send(t, r, "POST", "/api/pub/login", "", gin.H{
+			"username": "testuser", "password": password,
+		})
+		token, _ := result["token"].(string)
+		return code, token
+	}
+
+	// Estimation of values
+	_, token := login("abcdEFGH1234!@#$")
+	code, _ := send(t, r, "POST", "/api/auth/password", token, gin.H{
+		"password": "wrongpassword", "newPassword": "zyxwVUTS9876)(*&",
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/password", token, gin.H{
+		"password": "abcdEFGH1234!@#$", "newPassword": "weak",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(t, r, "POST", "/api/auth/password", token, gin.H{
+		"password": "abcdEFGH1234!@#$", "newPassword": "zyxwVUTS9876)(*&",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = login("zyxwVUTS9876)(*&")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, nobody := send(t, r, "POST", "/api/pub/password/forgot", "", gin.H{
+		"username": "nobody",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	// A mailer failure does not tell that the account exists
+	mailer.Err = errors.New("mail server is down")
+	code, result := send(t, r, "POST", "/api/pub/password/forgot", "", gin.H{
+		"username": "testuser",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, nobody, result)
+	mailer.Err = nil
+	code, _ = send(t, r, "POST", "/api/pub/password/forgot", "", gin.H{
+		"username": "testuser",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	messages := mailer.Messages("testuser@example.com")
+	assert.Len(t, messages, 1)
+	var reset string
+	for _, field := range strings.Fields(messages[0].Body) {
+		if link, err := url.Parse(field); err == nil && link.Scheme != "" {
+			reset = link.Query().Get("token")
+		}
+	}
+	assert.NotEmpty(t, reset)
+	code, _ = send(t, r, "POST", "/api/pub/password/reset", "", gin.H{
+		"token": reset, "password": "1234abcdEFGH$#@!",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "POST", "/api/pub/password/reset", "", gin.H{
+		"token": reset, "password": "1234abcdEFGH$#@!",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(t, r, "GET", "/api/auth/files", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, token = login("1234abcdEFGH$#@!")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "GET", "/api/auth/files", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+// Testing the removal of all user data in the handlers.DeleteAccount()
+// function.
+func TestDeleteAccount(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	user := models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	}
+	db.C.Create(&user)
+	userDir := fmt.Sprintf("upload/test/%d", user.ID)
+	assert.NoError(t, os.MkdirAll(userDir, 0755))
+	assert.NoError(t, os.WriteFile(userDir+"/test.file", []byte("test"), 0644))
+	db.C.Create(&models.File{
+		UserID:    user.ID,
+		ListName:  "test",
+		Name:      fmt.Sprintf("/%d/test.file", user.ID),
+		Extension: ".file",
+		Path:      userDir + "/test.file",
+		Date:      time.Now(),
+		Size:      4,
+	})
+
+	// Setup router
+	r := router()
+	_, result := send(t, r, "POST", "/api/pub/login", "", gin.H{
+		"username": "testuser", "password": "abcdEFGH1234!@#$",
+	})
+	token, _ := result["token"].(string)
+
+	// Estimation of values
+	code, _ := send(t, r, "POST", "/api/auth/account/delete", token, gin.H{
+		"password": "wrongpassword",
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/account/delete", token, gin.H{
+		"password": "abcdEFGH1234!@#$",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	_, err = os.Stat(userDir)
+	assert.True(t, os.IsNotExist(err))
+	var count int64
+	db.C.Unscoped().Model(&models.File{}).Count(&count)
+	assert.Zero(t, count)
+	db.C.Unscoped().Model(&models.Session{}).Count(&count)
+	assert.Zero(t, count)
+	db.C.Unscoped().Model(&models.User{}).Count(&count)
+	assert.Zero(t, count)
+	code, _ = send(t, r, "POST", "/api/auth/logout", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// Testing the mail address verification in the handlers.SignUp(),
+// handlers.VerifyEmail() and handlers.ResendVerification() functions.
+func TestVerifyEmail(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	mailer := &notify.Fake{}
+	handlers.Mailer = mailer
+
+	// Setup router
+	r := router()
+	upload := func(token string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("files", "test.file")
+		assert.NoError(t, err)
+		part.Write([]byte("test"))
+		writer.Close()
+		request, err := http.NewRequest(
+			"POST",
+			"http://127.0.0.1:8080/api/auth/upload",
+			body,
+		)
+		assert.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		return response.Code
+	}
+	lastToken := func() string {
+		messages := mailer.Messages("user@example.com")
+		if len(messages) == 0 {
+			return ""
+		}
+		for _, field := range strings.Fields(messages[len(messages)-1].Body) {
+			if link, err := url.Parse(field); err == nil && link.Scheme != "" {
+				return link.Query().Get("token")
+			}
+		}
+		return ""
+	}
+
+	// Estimation of values
+	code, _ := send(t, r, "POST", "/api/pub/signup", "", gin.H{
+		"username": "testuser",
+		"password": "abcdEFGH1234!@#$",
+		"email":    "not an address",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(t, r, "POST", "/api/pub/signup", "", gin.H{
+		"username": "testuser",
+		"password": "abcdEFGH1234!@#$",
+		"email":    "user@example.com",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	first := lastToken()
+	assert.NotEmpty(t, first)
+	_, result := send(t, r, "POST", "/api/pub/login", "", gin.H{
+		"username": "testuser", "password": "abcdEFGH1234!@#$",
+	})
+	token, _ := result["token"].(string)
+	assert.Equal(t, http.StatusForbidden, upload(token))
+	code, _ = send(t, r, "POST", "/api/auth/verify/resend", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+	second := lastToken()
+	assert.NotEqual(t, first, second)
+	code, _ = send(t, r, "POST", "/api/pub/verify", "", gin.H{"token": first})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(t, r, "POST", "/api/pub/verify", "", gin.H{"token": second})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, upload(token))
+	var user models.User
+	db.C.Where("username = ?", "testuser").First(&user)
+	assert.True(t, user.EmailVerified)
+	err := os.RemoveAll(fmt.Sprintf("upload/test/%d/", user.ID))
+	assert.NoError(t, err)
+	code, _ = send(t, r, "POST", "/api/auth/verify/resend", token, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// Testing a custom password policy with passphrases, Unicode
+// normalization, strength score and breached password list in the
+// handlers.SignUp() function.
+func TestPasswordPolicy(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+
+	// Create testing data
+	sum := sha1.Sum([]byte("correct horse battery staple"))
+	list := strings.ToUpper(hex.EncodeToString(sum[:])) + ":3\r\n"
+	path := t.TempDir() + "/breached.txt"
+	assert.NoError(t, os.WriteFile(path, []byte(list), 0644))
+	breached, err := passwords.OpenBreached(path)
+	assert.NoError(t, err)
+	defer breached.Close()
+	policy := handlers.PasswordPolicy
+	defer func() { handlers.PasswordPolicy = policy }()
+	handlers.PasswordPolicy = &passwords.Policy{
+		MinLength: 12,
+		Normalize: true,
+		MinScore:  3,
+		Breached:  breached,
+	}
+
+	// Setup router
+	r := router()
+	post := func(url string, data interface{}) int {
+		code, _ := send(t, r, "POST", url, "", data)
+		return code
+	}
+
+	// Estimation of values
+	code := post("/api/pub/signup", gin.H{
+		"username": "testuser", "password": "password1234",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code = post("/api/pub/signup", gin.H{
+		"username": "testuser", "password": "testuser testuser",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code = post("/api/pub/signup", gin.H{
+		"username": "testuser", "password": "correct horse battery staple",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	// "é" is composed on sign up and decomposed on login.
+	code = post("/api/pub/signup", gin.H{
+		"username": "testuser", "password": "caf\u00e9 на берегу моря",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code = post("/api/pub/login", gin.H{
+		"username": "testuser", "password": "cafe\u0301 на берегу моря",
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	// The reset checks the password against the user of the token
+	mailer := &notify.Fake{}
+	handlers.Mailer = mailer
+	handlers.MailDomain = "example.com"
+	code = post("/api/pub/password/forgot", gin.H{"username": "testuser"})
+	assert.Equal(t, http.StatusOK, code)
+	messages := mailer.Messages("testuser@example.com")
+	assert.Len(t, messages, 1)
+	var reset string
+	for _, field := range strings.Fields(messages[0].Body) {
+		if link, err := url.Parse(field); err == nil && link.Scheme != "" {
+			reset = link.Query().Get("token")
+		}
+	}
+	code = post("/api/pub/password/reset", gin.H{
+		"token": reset, "password": "testuser testuser",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code = post("/api/pub/password/reset", gin.H{
+		"token": reset, "password": "горы за рекой и cafe\u0301",
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	// bcrypt hashes only the first 72 bytes
+	long := strings.Repeat("пароль ", 6) // 42 characters, 78 bytes
+	settings := config.Password{MaxLength: 72, Hasher: passwords.Argon2id}
+	argon, err := passwords.NewPolicy(settings)
+	assert.NoError(t, err)
+	assert.NoError(t, argon.Check(long))
+	settings.Hasher = passwords.Bcrypt
+	bcrypted, err := passwords.NewPolicy(settings)
+	assert.NoError(t, err)
+	assert.Error(t, bcrypted.Check(long))
+}
+
+// Testing the replacement of bcrypt hashes and outdated argon2id
+// parameters on login in the passwords.Hasher and handlers.Local
+// types.
+func TestRehash(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	user := models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	}
+	db.C.Create(&user)
+
+	// Setup router
+	r := router()
+	login := func() int {
+		code, _ := send(t, r, "POST", "/api/pub/login", "", gin.H{
+			"username": "testuser", "password": "abcdEFGH1234!@#$",
+		})
+		return code
+	}
+	stored := func() string {
+		var entry models.User
+		db.C.First(&entry, user.ID)
+		return entry.Password
+	}
+
+	// Estimation of values
+	assert.Equal(t, http.StatusOK, login())
+	upgraded := stored()
+	assert.True(t, strings.HasPrefix(upgraded, "$argon2id$"))
+	assert.Equal(t, http.StatusOK, login())
+	assert.Equal(t, upgraded, stored())
+	hasher := handlers.PasswordHasher
+	defer func() { handlers.PasswordHasher = hasher }()
+	stronger := *hasher
+	stronger.Time++
+	handlers.PasswordHasher = &stronger
+	assert.Equal(t, http.StatusOK, login())
+	assert.NotEqual(t, upgraded, stored())
+	assert.Contains(t, stored(), fmt.Sprintf(",t=%d,", stronger.Time))
+	assert.Equal(t, http.StatusOK, login())
+}
+
+// Testing the verification of webtokens by the published keys in the
+// handlers.JWKS() function and the rotation of keys.Set.
+func TestJWKS(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	token, _, err := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	assert.NoError(t, err)
+	request, err := http.NewRequest(
+		"GET",
+		"http://127.0.0.1:8080/.well-known/jwks.json",
+		nil,
+	)
+	assert.NoError(t, err)
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	var jwks struct {
+		Keys []struct{ Kty, Kid, Alg, N, E, Crv, X, Y string }
+	}
+	json.Unmarshal(response.Body.Bytes(), &jwks)
+
+	// Estimation of values
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NotEmpty(t, jwks.Keys)
+	parsed, err := jwt4.Parse(token, func(token *jwt4.Token) (interface{}, error) {
+		for _, k := range jwks.Keys {
+			if k.Kid != token.Header["kid"] || k.Kty != "RSA" {
+				continue
+			}
+			n, _ := base64.RawURLEncoding.DecodeString(k.N)
+			e, _ := base64.RawURLEncoding.DecodeString(k.E)
+			return &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}, nil
+		}
+		return nil, keys.ErrUnknownKey
+	})
+	assert.NoError(t, err)
+	assert.True(t, parsed.Valid)
+
+	// Rotation of Ed25519 keys with a 2 hours overlap
+	now := time.Now().Add(time.Second)
+	set, err := keys.Load(t.TempDir(), keys.EdDSA, 24*time.Hour, 2*time.Hour)
+	assert.NoError(t, err)
+	published := func() int {
+		return len(set.JWKS()["keys"].([]map[string]interface{}))
+	}
+	first, err := set.Sign(jwt4.MapClaims{"id": user.ID})
+	assert.NoError(t, err)
+	assert.NoError(t, set.Rotate(now.Add(24*time.Hour)))
+	assert.Equal(t, 2, published())
+	second, _ := set.Sign(jwt4.MapClaims{"id": user.ID})
+	assert.Equal(t, strings.Split(first, ".")[0], strings.Split(second, ".")[0])
+	assert.NoError(t, set.Rotate(now.Add(26*time.Hour)))
+	third, _ := set.Sign(jwt4.MapClaims{"id": user.ID})
+	assert.NotEqual(t, strings.Split(first, ".")[0], strings.Split(third, ".")[0])
+	_, err = jwt4.Parse(first, set.KeyFunc)
+	assert.NoError(t, err)
+	assert.NoError(t, set.Rotate(now.Add(28*time.Hour)))
+	assert.Equal(t, 1, published())
+	_, err = jwt4.Parse(first, set.KeyFunc)
+	assert.Error(t, err)
+	_, err = jwt4.Parse(third, set.KeyFunc)
+	assert.NoError(t, err)
+
+	// The legacy key is retired but its file is kept
+	dir := t.TempDir()
+	legacy, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "priv.pem"), pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(legacy),
+	}), 0600)
+	assert.NoError(t, err)
+	set, err = keys.Load(dir, keys.EdDSA, 24*time.Hour, 2*time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, set.Rotate(now.Add(24*time.Hour)))
+	assert.NoError(t, set.Rotate(now.Add(26*time.Hour)))
+	assert.NoError(t, set.Rotate(now.Add(28*time.Hour)))
+	assert.Equal(t, 1, published())
+	assert.FileExists(t, filepath.Join(dir, "priv.pem"))
+}
+
+// Testing the order of the configuration sources, the validation and
+// the dump in the config.Load() and config.Dump() functions.
+func TestConfig(t *testing.T) {
+	// Setup configuration file
+	path := t.TempDir() + "/config.yaml"
+	err := os.WriteFile(path, []byte(
+		"server:\n"+
+			"  addr: \"0.0.0.0:9000\"\n"+
+			"db:\n"+
+			"  host: \"db.example.com\"\n"+
+			"  name: \"files\"\n"+
+			"jwt:\n"+
+			"  timeout: 30m\n"+
+			"security:\n"+
+			"  cors_origins: [\"https://a.example.com\", \"https://b.example.com\"]\n",
+	), 0600)
+	assert.NoError(t, err)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("DB_HOST", "env.example.com")
+	t.Setenv("DB_NAME", "")
+	t.Setenv("DB_PASSWORD", "s3cr3t")
+
+	// File, environment and flags
+	cfg, err := config.Load([]string{"-db.host", "flag.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:9000", cfg.Server.Addr)
+	assert.Equal(t, "flag.example.com", cfg.DB.Host)
+	assert.Equal(t, "files", cfg.DB.Name)
+	assert.Equal(t, "s3cr3t", cfg.DB.Password)
+	assert.Equal(t, 30*time.Minute, cfg.JWT.Timeout)
+	assert.Len(t, cfg.Security.CORSOrigins, 2)
+	assert.Equal(t, config.Default().Auth.LockoutTime, cfg.Auth.LockoutTime)
+	cfg, err = config.Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "env.example.com", cfg.DB.Host)
+	cfg, err = config.Load([]string{
+		"-security.cors_origins", "https://c.example.com, https://d.example.com",
+		"-security.ssl_redirect",
+	})
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]string{"https://c.example.com", "https://d.example.com"},
+		cfg.Security.CORSOrigins,
+	)
+	assert.True(t, cfg.Security.SSLRedirect)
+
+	// Validation
+	_, err = config.Load([]string{"-jwt.timeout", "1h", "-jwt.key_overlap", "1h", "-jwt.key_rotation", "720h"})
+	assert.ErrorContains(t, err, "jwt.key_overlap")
+	_, err = config.Load([]string{"-jwt.timeout", "soon"})
+	assert.Error(t, err)
+	_, err = config.Load([]string{"-auth.providers", "local,kerberos", "-password.classes", "5"})
+	assert.ErrorContains(t, err, "auth.providers")
+	assert.ErrorContains(t, err, "password.classes")
+	_, err = config.Load([]string{
+		"-auth.providers", "local,ldap",
+		"-ldap.url", "ldap://127.0.0.1:389",
+		"-ldap.group_roles", "cn=admins,dc=example,dc=com:Admin",
+	})
+	assert.ErrorContains(t, err, "ldap.group_roles")
+	_, err = config.Load([]string{
+		"-auth.providers", "local,ldap",
+		"-ldap.url", "ldap://127.0.0.1:389",
+		"-ldap.group_roles", "cn=admins,dc=example,dc=com:admin;cn=staff,dc=example,dc=com:read-only",
+	})
+	assert.NoError(t, err)
+	t.Setenv("STS_SECONDS", "many")
+	_, err = config.Load(nil)
+	assert.ErrorContains(t, err, "STS_SECONDS")
+	t.Setenv("STS_SECONDS", "")
+	os.WriteFile(path, []byte("db:\n  hots: \"db.example.com\"\n"), 0600)
+	_, err = config.Load(nil)
+	assert.ErrorContains(t, err, "hots")
+
+	// Dump with masked secrets
+	os.WriteFile(path, []byte{}, 0600)
+	cfg, err = config.Load(nil)
+	assert.NoError(t, err)
+	var dump bytes.Buffer
+	assert.NoError(t, config.Dump(&dump, cfg))
+	assert.NotContains(t, dump.String(), "s3cr3t")
+	assert.Contains(t, dump.String(), "password: '********'")
+	assert.Contains(t, dump.String(), "timeout: 1h0m0s")
+	os.WriteFile(path, dump.Bytes(), 0600)
+	t.Setenv("DB_PASSWORD", "")
+	loaded, err := config.Load(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.JWT, loaded.JWT)
+	assert.Equal(t, cfg.Security, loaded.Security)
+}
+
+// Testing the reload of the changed configuration file in the
+// config.Watch() and config.Reload() functions.
+func TestReload(t *testing.T) {
+	// Setup configuration file
+	previous := config.Get()
+	defer config.Set(previous)
+	path := t.TempDir() + "/config.yaml"
+	write := func(origin, level, host string) {
+		os.WriteFile(path, []byte(fmt.Sprintf(
+			"log:\n  level: %s\ndb:\n  host: %q\n"+
+				"security:\n  cors_origins: [%q]\n",
+			level, host, origin,
+		)), 0600)
+	}
+	write("https://a.example.com", "error", "127.0.0.1")
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("LOG_MODE", "")
+	t.Setenv("DB_HOST", "")
+	cfg, err := config.Load(nil)
+	assert.NoError(t, err)
+	config.Set(cfg)
+
+	// Setup router
+	gin.SetMode(gin.TestMode)
+	r := router()
+	preflight := func(origin string) int {
+		request, err := http.NewRequest(
+			"OPTIONS",
+			"http://127.0.0.1:8080/api/pub/login",
+			nil,
+		)
+		assert.NoError(t, err)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", "POST")
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		return response.Code
+	}
+	assert.Equal(t, http.StatusNoContent, preflight("https://a.example.com"))
+	assert.Equal(t, http.StatusForbidden, preflight("https://b.example.com"))
+
+	// Modification of the watched file
+	stop := make(chan struct{})
+	defer close(stop)
+	reloaded := make(chan []config.Change, 1)
+	go config.Watch(path, 10*time.Millisecond, stop, func() {
+		changes, err := config.Reload(nil)
+		assert.NoError(t, err)
+		reloaded <- changes
+	})
+	time.Sleep(50 * time.Millisecond)
+	write("https://b.example.com", "debug", "db.example.com")
+	var changes []config.Change
+	select {
+	case changes = <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("configuration is not reloaded")
+	}
+
+	// Estimation of values
+	applied := map[string]bool{}
+	for _, change := range changes {
+		applied[change.Key] = change.Applied
+	}
+	assert.Equal(t, map[string]bool{
+		"log.level":             true,
+		"db.host":               false,
+		"security.cors_origins": true,
+	}, applied)
+	assert.Equal(t, "127.0.0.1", config.Get().DB.Host)
+	assert.Equal(t, logrus.DebugLevel, logging.Config.GetLevel())
+	assert.Equal(t, http.StatusNoContent, preflight("https://b.example.com"))
+	assert.Equal(t, http.StatusForbidden, preflight("https://a.example.com"))
+
+	// An invalid file changes nothing
+	os.WriteFile(path, []byte("rate_limit:\n  login: -1\n"), 0600)
+	_, err = config.Reload(nil)
+	assert.ErrorContains(t, err, "rate_limit.login")
+	assert.Equal(
+		t,
+		[]string{"https://b.example.com"},
+		config.Get().Security.CORSOrigins,
+	)
+}
+
+// Testing the deletion of interrupted uploads at the start and the
+// shutdown of the server in the handlers.CleanPartialUploads() function.
+func TestCleanPartialUploads(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+
+	// Create testing data
+	dir := fmt.Sprintf("upload/test/%d/", user.ID)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"complete.file", "partial.file"} {
+		db.C.Create(&models.File{
+			UserID:   user.ID,
+			ListName: strings.TrimSuffix(name, ".file"),
+			Name:     fmt.Sprintf("/%d/", user.ID) + name,
+			Path:     dir + name,
+		})
+	}
+	os.WriteFile(dir+"complete.file", []byte("complete"), 0644)
+	os.WriteFile(dir+"partial.file.part", []byte("part"), 0644)
+	handlers.CleanPartialUploads()
+
+	// Estimation of values
+	var entries []models.File
+	db.C.Where("user_id = ?", user.ID).Find(&entries)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, dir+"complete.file", entries[0].Path)
+	_, err := os.Stat(dir + "complete.file")
+	assert.NoError(t, err)
+	_, err = os.Stat(dir + "partial.file.part")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// Testing the reload of the server certificate in the certs.Reloader
+// type, the HTTPS redirect and the client certificate requirement of
+// API keys in the middleware.APIKey() function.
+func TestTLS(t *testing.T) {
+	// Create testing data
+	dir := t.TempDir()
+	writeCert := func(name string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		assert.NoError(t, err)
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+		os.WriteFile(dir+"/cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+		os.WriteFile(dir+"/key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	commonName := func(r *certs.Reloader) string {
+		cert, err := r.GetCertificate(nil)
+		assert.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+
+	// Reload of the changed certificate
+	writeCert("old.example.com")
+	reloader, err := certs.Load(dir+"/cert.pem", dir+"/key.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, "old.example.com", commonName(reloader))
+	reloaded, err := reloader.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+	writeCert("new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(dir+"/cert.pem", later, later)
+	reloaded, err = reloader.Reload()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "new.example.com", commonName(reloader))
+	os.WriteFile(dir+"/key.pem", []byte("broken"), 0600)
+	os.Chtimes(dir+"/key.pem", later.Add(time.Minute), later.Add(time.Minute))
+	_, err = reloader.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "new.example.com", commonName(reloader))
+
+	// Redirect to HTTPS
+	redirect := func(addr, sslHost string) string {
+		request := httptest.NewRequest(
+			"GET",
+			"http://files.example.com:8080/api/auth/files?sort=name",
+			nil,
+		)
+		response := httptest.NewRecorder()
+		redirectHTTPS(addr, sslHost).ServeHTTP(response, request)
+		assert.Equal(t, http.StatusPermanentRedirect, response.Code)
+		return response.Header().Get("Location")
+	}
+	assert.Equal(
+		t,
+		"https://files.example.com:8443/api/auth/files?sort=name",
+		redirect(":8443", ""),
+	)
+	assert.Equal(
+		t,
+		"https://files.example.com/api/auth/files?sort=name",
+		redirect(":443", ""),
+	)
+	assert.Equal(
+		t,
+		"https://ssl.example.com/api/auth/files?sort=name",
+		redirect(":8443", "ssl.example.com"),
+	)
+	assert.Equal(
+		t,
+		"https://files.example.com:8443/api/auth/files?sort=name",
+		redirect(":8443", config.Default().Security.SSLHost),
+	)
+
+	// API key without client certificate
+	previous := config.Get()
+	defer config.Set(previous)
+	cfg := *previous
+	cfg.TLS.APIKeyClientCert = true
+	config.Set(&cfg)
+	gin.SetMode(gin.TestMode)
+	r := router()
+	request, err := http.NewRequest(
+		"GET",
+		"http://127.0.0.1:8080/api/auth/files",
+		nil,
+	)
+	assert.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+handlers.APIKeyPrefix+"0123")
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	assert.Contains(t, response.Body.String(), "client certificate required")
+}
+
+// Testing the probes of the handlers.Live(), handlers.Ready() and
+// handlers.Health() functions.
+func TestHealth(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	r := router()
+	internal := internalRouter()
+	probe := func(path string) (int, map[string]interface{}) {
+		// Probes connect by the address of the instance, which is not
+		// an allowed host
+		request, err := http.NewRequest("GET", "http://10.0.0.5:8080"+path, nil)
+		assert.NoError(t, err)
+		response := httptest.NewRecorder()
+		if path == "/healthz" {
+			internal.ServeHTTP(response, request)
+		} else {
+			r.ServeHTTP(response, request)
+		}
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &body))
+		return response.Code, body
+	}
+
+	// Estimation of values
+	code, body := probe("/livez")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["status"])
+	code, body = probe("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"status": "ok"}, body)
+	code, body = probe("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	checks := body["checks"].(map[string]interface{})
+	for _, name := range []string{"database", "storage", "keys"} {
+		assert.Equal(t, "ok", checks[name].(map[string]interface{})["status"])
+	}
+
+	// Low free disk space
+	previous := config.Get()
+	defer config.Set(previous)
+	cfg := *previous
+	cfg.Storage.MinFreeSpace = 1 << 62
+	config.Set(&cfg)
+	code, body = probe("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, map[string]interface{}{"status": "unavailable"}, body)
+	code, body = probe("/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	checks = body["checks"].(map[string]interface{})
+	storage := checks["storage"].(map[string]interface{})
+	assert.Equal(t, "fail", storage["status"])
+	assert.Contains(t, storage["error"], "free disk space is low")
+	assert.Equal(t, "ok", checks["database"].(map[string]interface{})["status"])
+	code, _ = probe("/livez")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Health details are not public on the main listener
+	code, _ = send(t, r, "GET", "/healthz", "", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	cfg.Server.MetricsAddr = ""
+	config.Set(&cfg)
+	code, _ = send(t, router(), "GET", "/healthz", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// Testing the counters of the metrics.Middleware() and
+// metrics.Login() functions and the storage gauges of the /metrics
+// endpoint.
+func TestMetrics(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	user := models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+		Files: []models.File{
+			{
+				ListName:  "file1",
+				Name:      "/1/file1.txt",
+				Extension: "txt",
+				Path:      "/path/to/file1.txt",
+				Date:      time.Now(),
+				Size:      1024,
+			},
+		},
+	}
+	db.C.Create(&user)
+	admin := models.User{
+		Username: "testadmin",
+		Password: "testpassword",
+		Role:     models.RoleAdmin,
+	}
+	db.C.Create(&admin)
+	success := testutil.ToFloat64(metrics.Logins.WithLabelValues("success"))
+	failure := testutil.ToFloat64(metrics.Logins.WithLabelValues("failure"))
+
+	// Setup router, metrics on the main listener
+	previous := config.Get()
+	defer config.Set(previous)
+	cfg := *previous
+	cfg.Server.MetricsAddr = ""
+	config.Set(&cfg)
+	r := router()
+	authJWT := middleware.JWT()
+	token, _, _ := authJWT.TokenGenerator(&models.User{ID: admin.ID})
+	userToken, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	for _, password := range []string{"abcdEFGH1234!@#$", "wrongpassword"} {
+		jsonData, err := json.Marshal(models.User{
+			Username: "testuser",
+			Password: password,
+		})
+		assert.NoError(t, err)
+		request, err := http.NewRequest(
+			"POST",
+			"http://127.0.0.1:8080/api/pub/login",
+			bytes.NewBuffer(jsonData),
+		)
+		assert.NoError(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	code, _ := send(t, r, "GET", "/metrics", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = send(t, r, "GET", "/metrics", userToken, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	request, err := http.NewRequest("GET", "http://10.0.0.5:8080/metrics", nil)
+	assert.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	body := response.Body.String()
+
+	// Estimation of values
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, success+1, testutil.ToFloat64(metrics.Logins.WithLabelValues("success")))
+	assert.Equal(t, failure+1, testutil.ToFloat64(metrics.Logins.WithLabelValues("failure")))
+	assert.Contains(t, body, `http_requests_total{code="200",method="POST",route="/api/pub/login"}`)
+	assert.Contains(t, body, `http_requests_total{code="401",method="POST",route="/api/pub/login"}`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="POST",route="/api/pub/login"}`)
+	assert.Contains(t, body, `db_query_duration_seconds_count{operation="SELECT",status="ok"}`)
+	assert.Contains(t, body, "storage_files 1\n")
+	assert.Contains(t, body, "storage_used_bytes 1024\n")
+	assert.Contains(t, body, "upload_workers_busy 0\n")
+
+	// Metrics on a separate listener
+	cfg.Server.MetricsAddr = "127.0.0.1:9090"
+	config.Set(&cfg)
+	response = httptest.NewRecorder()
+	router().ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+// Testing the spans of the tracing.Middleware(), tracing.Query() and
+// tracing.Storage() functions and the W3C trace context propagation.
+func TestTracing(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+
+	// Setup tracing, only traces with a sampled parent are recorded
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.Start(exporter, config.Tracing{
+		ServiceName: "spa-api",
+		SampleRatio: 0,
+	})
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	// Create testing data
+	file, err := os.Open("upload/test.file")
+	assert.NoError(t, err)
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("files", "test.file")
+	assert.NoError(t, err)
+	_, err = io.Copy(part, file)
+	assert.NoError(t, err)
+	writer.Close()
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	token, _, _ := authJWT.TokenGenerator(&models.User{
+		ID: user.ID,
+	})
+	request, err := http.NewRequest(
+		"POST",
+		"http://127.0.0.1:8080/api/auth/upload",
+		body,
+	)
+	assert.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set(
+		"traceparent",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	)
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	os.RemoveAll(fmt.Sprintf("upload/test/%d/", user.ID))
+	request, err = http.NewRequest("GET", "http://127.0.0.1:8080/api/auth/files", nil)
+	assert.NoError(t, err)
+	request.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(httptest.NewRecorder(), request)
+	assert.NoError(t, provider.ForceFlush(context.Background()))
+
+	// Get spans by name
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	root, ok := spans["POST /api/auth/upload"]
+	assert.True(t, ok)
+	save, saveOk := spans["storage.save"]
+	insert, insertOk := spans["INSERT"]
+
+	// Estimation of values
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", root.Parent.SpanID().String())
+	assert.Contains(t, root.Attributes, semconv.HTTPStatusCode(http.StatusOK))
+	assert.True(t, saveOk)
+	assert.Equal(t, root.SpanContext.SpanID(), save.Parent.SpanID())
+	assert.True(t, insertOk)
+	assert.Equal(t, root.SpanContext.SpanID(), insert.Parent.SpanID())
+	_, listed := spans["GET /api/auth/files"]
+	assert.False(t, listed)
+
+	// Statements are recorded without bound values
+	exporter.Reset()
+	ctx := trace.ContextWithRemoteSpanContext(
+		context.Background(),
+		trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    root.SpanContext.TraceID(),
+			SpanID:     root.SpanContext.SpanID(),
+			TraceFlags: trace.FlagsSampled,
+		}),
+	)
+	db.C.WithContext(ctx).Model(&user).Update("totp_secret", "JBSWY3DPEHPK3PXP")
+	assert.NoError(t, provider.ForceFlush(context.Background()))
+	var statement string
+	for _, span := range exporter.GetSpans() {
+		for _, attr := range span.Attributes {
+			if span.Name == "UPDATE" && attr.Key == semconv.DBStatementKey {
+				statement = attr.Value.AsString()
+			}
+		}
+	}
+	assert.Contains(t, statement, "totp_secret")
+	assert.NotContains(t, statement, "JBSWY3DPEHPK3PXP")
+}
+
+// Testing the JSON log entries with request IDs of the
+// middleware.RequestID() and middleware.AccessLog() functions and the
+// redaction of secret fields.
+func TestLogging(t *testing.T) {
+	// Setup JSON logging into a file
+	gin.SetMode(gin.TestMode)
+	previous := config.Get()
+	defer config.Set(previous)
+	cfg := *previous
+	cfg.Log.Format = "json"
+	cfg.Log.Level = "debug"
+	cfg.Log.File = t.TempDir() + "/test.log"
+	config.Set(&cfg)
+	var read int
+	entries := func() []map[string]interface{} {
+		data, _ := os.ReadFile(cfg.Log.File)
+		lines := strings.TrimSpace(string(data[read:]))
+		read = len(data)
+		if lines == "" {
+			return nil
+		}
+		var list []map[string]interface{}
+		for _, line := range strings.Split(lines, "\n") {
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+			list = append(list, entry)
+		}
+		return list
+	}
+
+	// Request with an ID and invalid login values
+	r := router()
+	entries()
+	request, err := http.NewRequest(
+		"POST",
+		"http://127.0.0.1:8080/api/pub/login?token=secret-token",
+		strings.NewReader(`{"username": "testuser", "password": 1234}`),
+	)
+	assert.NoError(t, err)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Request-ID", "proxy-1234")
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	assert.Equal(t, "proxy-1234", response.Header().Get("X-Request-ID"))
+	list := entries()
+	assert.NotEmpty(t, list)
+	for _, entry := range list {
+		assert.Equal(t, "proxy-1234", entry["request_id"])
+	}
+	access := list[len(list)-1]
+	assert.Equal(t, "/api/pub/login", access["path"])
+	assert.Equal(t, float64(http.StatusUnauthorized), access["status"])
+
+	// Request without ID and an invalid ID
+	for _, id := range []string{"", "bad id\n"} {
+		request, err = http.NewRequest("GET", "http://127.0.0.1:8080/.well-known/jwks.json", nil)
+		assert.NoError(t, err)
+		request.Header.Set("X-Request-ID", id)
+		response = httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		generated := response.Header().Get("X-Request-ID")
+		assert.Regexp(t, "^[0-9a-f]{32}$", generated)
+		list = entries()
+		assert.Equal(t, generated, list[len(list)-1]["request_id"])
+	}
+
+	// Redaction of secret fields
+	logging.Ctx(context.Background()).WithFields(logrus.Fields{
+		"username":      "testuser",
+		"password":      "abcdEFGH1234!@#$",
+		"refresh_token": "refresh-value",
+		"totp_secret":   "JBSWY3DPEHPK3PXP",
+	}).Error("values")
+	list = entries()
+	assert.Len(t, list, 1)
+	assert.Equal(t, "testuser", list[0]["username"])
+	assert.Equal(t, logging.Redacted, list[0]["password"])
+	assert.Equal(t, logging.Redacted, list[0]["refresh_token"])
+	assert.Equal(t, logging.Redacted, list[0]["totp_secret"])
+	assert.NotContains(t, list[0], "request_id")
+}
+
+// Testing the levels of the file and syslog sinks of the
+// logging.Logger() function.
+func TestLogSinks(t *testing.T) {
+	// Setup syslog server
+	dir := t.TempDir()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
+		Name: dir + "/syslog.sock",
+		Net:  "unixgram",
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// Setup sinks
+	previous := config.Get()
+	defer config.Set(previous)
+	cfg := *previous
+	cfg.Log.Level = "info"
+	cfg.Log.File = dir + "/test.log"
+	cfg.Log.FileLevel = "warn"
+	cfg.Log.Syslog = "unixgram://" + dir + "/syslog.sock"
+	cfg.Log.SyslogLevel = "debug"
+	assert.NoError(t, cfg.Validate())
+	config.Set(&cfg)
+	logging.Config.Debug("debug entry")
+	logging.Config.Warn("warn entry")
+
+	// Get sink values
+	file, err := os.ReadFile(cfg.Log.File)
+	assert.NoError(t, err)
+	var messages []string
+	buffer := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buffer)
+		assert.NoError(t, err)
+		messages = append(messages, string(buffer[:n]))
+	}
+
+	// Estimation of values
+	assert.Equal(t, logrus.DebugLevel, logging.Config.GetLevel())
+	assert.NotContains(t, string(file), "debug entry")
+	assert.Contains(t, string(file), "warn entry")
+	// Priority of the daemon facility and the severity
+	assert.True(t, strings.HasPrefix(messages[0], "<31>"), messages[0])
+	assert.Contains(t, messages[0], "debug entry")
+	assert.True(t, strings.HasPrefix(messages[1], "<28>"), messages[1])
+	assert.Contains(t, messages[1], "warn entry")
+	assert.Contains(t, messages[1], "spa-api")
+}
+
+// Testing the audit log in the handlers.Activity() and
+// handlers.AuditExport() functions.
+func TestAudit(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	hashedPass, err := bcrypt.GenerateFromPassword(
+		[]byte("abcdEFGH1234!@#$"), bcrypt.DefaultCost,
+	)
+	assert.NoError(t, err)
+	user := models.User{
+		Username: "testuser",
+		Password: string(hashedPass),
+	}
+	db.C.Create(&user)
+	admin := models.User{
+		Username: "testadmin",
+		Password: "testpassword",
+		Role:     models.RoleAdmin,
+	}
+	db.C.Create(&admin)
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	adminToken, _, _ := authJWT.TokenGenerator(&models.User{ID: admin.ID})
+	call := func(method, url, token string, data interface{}) (int, []byte) {
+		request := newRequest(t, method, url, token, data)
+		request.Header.Set("User-Agent", "audit-agent")
+		request.Header.Set("X-Request-ID", "audit-request")
+		response := httptest.NewRecorder()
+		r.ServeHTTP(response, request)
+		return response.Code, response.Body.Bytes()
+	}
+	call("POST", "/api/pub/login", "", gin.H{
+		"username": "testuser", "password": "wrongpassword",
+	})
+	_, body := call("POST", "/api/pub/login", "", gin.H{
+		"username": "testuser", "password": "abcdEFGH1234!@#$",
+	})
+	var login gin.H
+	json.Unmarshal(body, &login)
+	token, _ := login["token"].(string)
+	call("POST", "/api/auth/delete", token, gin.H{"id": 100})
+
+	// Estimation of values
+	code, body := call("GET", "/api/auth/activity?limit=2", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+	var activity struct{ Events []models.AuditEvent }
+	assert.NoError(t, json.Unmarshal(body, &activity))
+	assert.Len(t, activity.Events, 2)
+	if len(activity.Events) == 2 {
+		assert.Equal(t, models.ActionDelete, activity.Events[0].Action)
+		assert.Equal(t, models.OutcomeFailure, activity.Events[0].Outcome)
+		assert.Equal(t, "audit-agent", activity.Events[0].UserAgent)
+		assert.Equal(t, "audit-request", activity.Events[0].RequestID)
+		assert.Equal(t, models.ActionLogin, activity.Events[1].Action)
+		assert.Equal(t, models.OutcomeSuccess, activity.Events[1].Outcome)
+		code, body = call(
+			"GET",
+			fmt.Sprintf("/api/auth/activity?before=%d", activity.Events[1].ID),
+			token,
+			nil,
+		)
+		assert.Equal(t, http.StatusOK, code)
+		assert.NoError(t, json.Unmarshal(body, &activity))
+		assert.Len(t, activity.Events, 1)
+	}
+	code, _ = call("GET", "/api/admin/audit/export", token, nil)
+	assert.Equal(t, http.StatusForbidden, code)
+	code, body = call(
+		"GET",
+		fmt.Sprintf("/api/admin/audit/export?user=%d", user.ID),
+		adminToken,
+		nil,
+	)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(body)), "\n"), 3)
+	code, body = call(
+		"GET", "/api/admin/audit/export?format=csv", adminToken, nil,
+	)
+	assert.Equal(t, http.StatusOK, code)
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 4)
+	// Cells that start like a formula are quoted
+	db.C.Create(&models.AuditEvent{
+		ActorID:   admin.ID,
+		Action:    models.ActionDownload,
+		Target:    "=HYPERLINK(\"http://example.com\")",
+		UserAgent: "@SUM(A1)",
+		Detail:    "-1",
+	})
+	code, body = call(
+		"GET",
+		fmt.Sprintf("/api/admin/audit/export?format=csv&user=%d", admin.ID),
+		adminToken,
+		nil,
+	)
+	assert.Equal(t, http.StatusOK, code)
+	records, err = csv.NewReader(bytes.NewReader(body)).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "'=HYPERLINK(\"http://example.com\")", records[1][6])
+		assert.Equal(t, "'@SUM(A1)", records[1][8])
+		assert.Equal(t, "'-1", records[1][10])
+	}
+	code, _ = call("GET", "/api/admin/audit/export?format=xml", adminToken, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = call("GET", "/api/admin/audit/export?from=yesterday", adminToken, nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Invalid page sizes fall back to the default
+	for i := 0; i < 60; i++ {
+		db.C.Create(&models.AuditEvent{ActorID: user.ID, Action: models.ActionDownload})
+	}
+	for limit, count := range map[string]int{"-1": 50, "many": 50, "1000": 63} {
+		code, body = call("GET", "/api/auth/activity?limit="+limit, token, nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.NoError(t, json.Unmarshal(body, &activity))
+		assert.Len(t, activity.Events, count, limit)
+	}
+}
+
+// Testing the file events stream in the handlers.Events() function.
+func TestEvents(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+	path := filepath.Join(t.TempDir(), "test.file")
+	assert.NoError(t, os.WriteFile(path, []byte("test"), 0o600))
+	file := models.File{
+		UserID:    user.ID,
+		ListName:  "test",
+		Name:      fmt.Sprintf("/%d/test.file", user.ID),
+		Extension: ".file",
+		Path:      path,
+		Date:      time.Now(),
+		Size:      4,
+	}
+	db.C.Create(&file)
+
+	// Setup server
+	heartbeat := handlers.EventsHeartbeat
+	handlers.EventsHeartbeat = 50 * time.Millisecond
+	defer func() { handlers.EventsHeartbeat = heartbeat }()
+	server := httptest.NewServer(router())
+	defer server.Close()
+	authJWT := middleware.JWT()
+	token, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	// Opens a stream with the token and returns its reader.
+	open := func(token string) (*http.Response, *bufio.Reader) {
+		request, err := http.NewRequest("GET", server.URL+"/api/auth/events", nil)
+		assert.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err)
+		return response, bufio.NewReader(response.Body)
+	}
+	response, reader := open(token)
+	defer response.Body.Close()
+	// Returns the name and the data of the next event.
+	next := func(reader *bufio.Reader) (string, models.File) {
+		var name string
+		var data models.File
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return name, data
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "" && name != "":
+				return name, data
+			case strings.HasPrefix(line, "event:"):
+				name = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &data)
+			}
+		}
+	}
+
+	// Estimation of values
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	name, _ := next(reader)
+	assert.Equal(t, "ready", name)
+	code, _ := send(t, server.Config.Handler, "POST", "/api/auth/rename", token, gin.H{
+		"id": file.ID, "name": "renamed", "extension": ".file",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	name, data := next(reader)
+	assert.Equal(t, events.FileRenamed, name)
+	assert.Equal(t, file.ID, data.ID)
+	assert.Equal(t, "renamed", data.ListName)
+	code, _ = send(t, server.Config.Handler, "POST", "/api/auth/delete", token, gin.H{"id": file.ID})
+	assert.Equal(t, http.StatusOK, code)
+	name, data = next(reader)
+	assert.Equal(t, events.FileDeleted, name)
+	assert.Equal(t, file.ID, data.ID)
+
+	// Streams end when their credentials are revoked
+	code, result := send(t, server.Config.Handler, "POST", "/api/auth/keys/create", token, gin.H{
+		"name": "sync script", "scope": models.ScopeRead,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	key, _ := result["key"].(string)
+	keyResponse, keyReader := open(key)
+	defer keyResponse.Body.Close()
+	name, _ = next(keyReader)
+	assert.Equal(t, "ready", name)
+	code, _ = send(t, server.Config.Handler, "POST", "/api/auth/keys/revoke", token, gin.H{
+		"id": result["ID"],
+	})
+	assert.Equal(t, http.StatusOK, code)
+	name, _ = next(keyReader)
+	assert.Equal(t, "revoked", name)
+	code, _ = send(t, server.Config.Handler, "POST", "/api/auth/logout/all", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+	name, _ = next(reader)
+	assert.Equal(t, "revoked", name)
+
+	// Removed handlers get no more events
+	bus := events.NewBus()
+	handled := 0
+	remove := bus.Handle(func(events.Event) { handled++ })
+	bus.Publish(events.Event{Type: events.FileCreated, UserID: user.ID})
+	remove()
+	bus.Publish(events.Event{Type: events.FileCreated, UserID: user.ID})
+	assert.Equal(t, 1, handled)
+}
+
+// Testing webhooks of file events in the handlers.CreateWebhook(),
+// webhooks.Enqueue() and webhooks.Deliver() functions.
+func TestWebhooks(t *testing.T) {
+	// Setup test database
+	gin.SetMode(gin.TestMode)
+	db.Connect()
+	db.C.AutoMigrate(models.Tables()...)
+	defer db.C.Migrator().DropTable(models.Tables()...)
+	previous := config.Get()
+	defer config.Set(previous)
+	cfg := *previous
+	cfg.Webhooks.AllowPrivate = true
+	cfg.Webhooks.MaxAttempts = 2
+	config.Set(&cfg)
+	remove := events.Handle(webhooks.Enqueue)
+	defer remove()
+	user := models.User{
+		Username: "testuser",
+		Password: "testpassword",
+	}
+	db.C.Create(&user)
+	admin := models.User{
+		Username: "testadmin",
+		Password: "testpassword",
+		Role:     models.RoleAdmin,
+	}
+	db.C.Create(&admin)
+	path := filepath.Join(t.TempDir(), "test.file")
+	assert.NoError(t, os.WriteFile(path, []byte("test"), 0o600))
+	file := models.File{
+		UserID:    user.ID,
+		ListName:  "test",
+		Name:      fmt.Sprintf("/%d/test.file", user.ID),
+		Extension: ".file",
+		Path:      path,
+		Date:      time.Now(),
+		Size:      4,
+	}
+	db.C.Create(&file)
+
+	// Setup receivers
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			requests <- received{r.Header, body}
+		},
+	))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	))
+	defer failing.Close()
+
+	// Setup router
+	r := router()
+	authJWT := middleware.JWT()
+	userToken, _, _ := authJWT.TokenGenerator(&models.User{ID: user.ID})
+	adminToken, _, _ := authJWT.TokenGenerator(&models.User{ID: admin.ID})
+
+	// Estimation of values
+	code, _ := send(t, r, "POST", "/api/auth/webhooks/create", userToken, gin.H{
+		"url": "ftp://example.com",
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = send(t, r, "POST", "/api/auth/webhooks/create", userToken, gin.H{
+		"url": receiver.URL, "events": []string{"file.shared"},
+	})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, result := send(t, r, "POST", "/api/auth/webhooks/create", userToken, gin.H{
+		"url": receiver.URL, "events": []string{events.FileRenamed},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	secret, _ := result["secret"].(string)
+	assert.True(t, strings.HasPrefix(secret, handlers.WebhookSecretPrefix))
+	code, result = send(t, r, "POST", "/api/admin/webhooks/create", adminToken, gin.H{
+		"url": failing.URL,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	failingID, _ := result["ID"].(float64)
+	code, _ = send(t, r, "POST", "/api/admin/webhooks/create", userToken, gin.H{
+		"url": failing.URL,
+	})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = send(t, r, "POST", "/api/auth/rename", userToken, gin.H{
+		"id": file.ID, "name": "renamed", "extension": ".file",
+	})
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(t, r, "POST", "/api/auth/delete", userToken, gin.H{"id": file.ID})
+	assert.Equal(t, http.StatusOK, code)
+
+	// The user webhook receives only renames, the admin one everything
+	assert.Equal(t, 3, webhooks.Deliver(context.Background()))
+	select {
+	case request := <-requests:
+		assert.Equal(t, events.FileRenamed, request.header.Get(webhooks.HeaderEvent))
+		timestamp := request.header.Get(webhooks.HeaderTimestamp)
+		assert.Equal(
+			t,
+			"sha256="+webhooks.Sign(secret, timestamp, request.body),
+			request.header.Get(webhooks.HeaderSignature),
+		)
+		var payload webhooks.Payload
+		assert.NoError(t, json.Unmarshal(request.body, &payload))
+		assert.Equal(t, file.ID, payload.File.ID)
+		assert.Equal(t, "renamed", payload.File.Name)
+	default:
+		t.Error("webhook is not delivered")
+	}
+	code, result = send(t, r, "GET", "/api/auth/webhooks/deliveries", userToken, nil)
+	assert.Equal(t, http.StatusOK, code)
+	deliveries, _ := result["deliveries"].([]interface{})
+	assert.Len(t, deliveries, 1)
+
+	// Failed deliveries are retried after the backoff
+	var pending []models.WebhookDelivery
+	db.C.Where("webhook_id = ?", uint(failingID)).Find(&pending)
+	assert.Len(t, pending, 2)
+	for _, delivery := range pending {
+		assert.Equal(t, models.DeliveryPending, delivery.Status)
+		assert.Equal(t, 1, delivery.Attempts)
+		assert.Equal(t, http.StatusServiceUnavailable, delivery.ResponseCode)
+		assert.True(t, delivery.NextAttempt.After(time.Now()))
+	}
+	assert.Equal(t, 0, webhooks.Deliver(context.Background()))
+	db.C.Model(&models.WebhookDelivery{}).
+		Where("webhook_id = ?", uint(failingID)).
+		Update("next_attempt", time.Now())
+	assert.Equal(t, 2, webhooks.Deliver(context.Background()))
+	code, result = send(t, r, "GET", "/api/admin/webhooks/deliveries", adminToken, nil)
+	assert.Equal(t, http.StatusOK, code)
+	deliveries, _ = result["deliveries"].([]interface{})
+	assert.Len(t, deliveries, 2)
+	for _, v := range deliveries {
+		delivery := v.(map[string]interface{})
+		assert.Equal(t, models.DeliveryFailed, delivery["Status"])
+	}
+	code, _ = send(t, r, "POST", "/api/admin/webhooks/delete", adminToken, gin.H{
+		"id": failingID,
+	})
+	assert.Equal(t, http.StatusOK, code)
+	var count int64
+	db.C.Model(&models.WebhookDelivery{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
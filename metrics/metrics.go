@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry of the service metrics, exposed by Handler().
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	requests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	latency = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	queries = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Duration of database queries by operation and status.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "status"})
+)
+
+var (
+	UploadedBytes = factory.NewCounter(prometheus.CounterOpts{
+		Name: "files_uploaded_bytes_total",
+		Help: "Bytes of the saved uploaded files.",
+	})
+	DownloadedBytes = factory.NewCounter(prometheus.CounterOpts{
+		Name: "files_downloaded_bytes_total",
+		Help: "Bytes of the files sent to clients.",
+	})
+	UploadWorkers = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "upload_workers_busy",
+		Help: "Upload workers that are saving files.",
+	})
+	UploadQueue = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "upload_queue_files",
+		Help: "Uploaded files waiting for a free worker.",
+	})
+	Logins = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "logins_total",
+		Help: "Password logins by result, success or failure.",
+	}, []string{"result"})
+	WebhookDeliveries = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Webhook delivery attempts by result, success or failure.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Returns the handler of the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Counts the requests and measures their duration. The route is the
+// pattern of the matched route, so path parameters and unknown paths
+// do not create new series.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		code := strconv.Itoa(c.Writer.Status())
+		requests.WithLabelValues(route, method, code).Inc()
+		latency.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Records the duration of a SQL statement of the operation, such as
+// SELECT or INSERT.
+func Query(operation string, elapsed time.Duration, failed bool) {
+	status := "ok"
+	if failed {
+		status = "error"
+	}
+	queries.WithLabelValues(operation, status).Observe(elapsed.Seconds())
+}
+
+// Counts a password login.
+func Login(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	Logins.WithLabelValues(result).Inc()
+}
+
+// Counts a webhook delivery attempt.
+func Webhook(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	WebhookDeliveries.WithLabelValues(result).Inc()
+}
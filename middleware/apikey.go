@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"net/http"
+	"spa-api/config"
+	db "spa-api/database"
+	"spa-api/handlers"
+	"spa-api/logging"
+	"spa-api/models"
+	"strings"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Authentication of the "/api/auth" routes. Accepts a personal API key
+// or a webtoken of gin-jwt/v2 middleware in the Authorization header.
+func Auth(authJWT *Tokens) []gin.HandlerFunc {
+	return []gin.HandlerFunc{
+		APIKey(),
+		unlessAPIKey(authJWT.MiddlewareFunc()),
+		unlessAPIKey(Revocation()),
+	}
+}
+
+// Authenticates requests with a personal API key. Claims of the key
+// are stored like the webtoken claims, so handlers can use
+// jwt.ExtractClaims() for both.
+func APIKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		auth := c.GetHeader("Authorization")
+		key, found := strings.CutPrefix(auth, "Bearer ")
+		if !found || !strings.HasPrefix(key, handlers.APIKeyPrefix) {
+			c.Next()
+			return
+		}
+		if config.Get().TLS.APIKeyClientCert && !clientCert(c) {
+			log.WithFields(logrus.Fields{
+				"IP": c.ClientIP(),
+			}).Warn(logging.F() + "() API key without client certificate")
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"code": http.StatusUnauthorized, "message": "client certificate required"},
+			)
+			return
+		}
+		entry, err := handlers.FindAPIKey(key)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"IP": c.ClientIP(),
+			}).Warn(logging.F()+"() invalid API key:", err)
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"code": http.StatusUnauthorized, "message": "invalid API key"},
+			)
+			return
+		}
+		var user models.User
+		dbReq := db.C.Select("id", "role", "disabled").First(&user, entry.UserID)
+		if dbReq.Error != nil || user.Disabled {
+			log.WithFields(logrus.Fields{
+				"ID": entry.UserID,
+			}).Warn(logging.F()+"() API key of disabled user:", dbReq.Error)
+			c.AbortWithStatusJSON(
+				http.StatusUnauthorized,
+				gin.H{"code": http.StatusUnauthorized, "message": "account is disabled"},
+			)
+			return
+		}
+		c.Set("api_key", entry)
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{
+			"id":    float64(entry.UserID),
+			"role":  user.Role,
+			"scope": entry.Scope,
+		})
+		// Usage is saved no more than once a minute.
+		if time.Since(entry.LastUsed) > time.Minute {
+			handlers.TouchAPIKey(entry)
+		}
+		c.Next()
+	}
+}
+
+// Reports whether the TLS connection has a client certificate verified
+// by the client CA file.
+func clientCert(c *gin.Context) bool {
+	return c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0
+}
+
+func unlessAPIKey(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key"); ok {
+			c.Next()
+			return
+		}
+		next(c)
+	}
+}
+
+// Allows the route only for the required scope of the API key. Read and
+// upload routes are also allowed for the full scope. Webtokens have no
+// scope claim and are allowed everywhere.
+func Scope(required string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope, ok := jwt.ExtractClaims(c)["scope"].(string)
+		if ok && scope != required && scope != models.ScopeFull {
+			c.AbortWithStatusJSON(
+				http.StatusForbidden,
+				gin.H{"code": http.StatusForbidden, "message": "API key scope does not allow this operation"},
+			)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Rejects requests authenticated by an API key. Credentials and the
+// account are managed only in interactive sessions, so a leaked key
+// cannot create more keys or take over the account.
+func Interactive() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key"); ok {
+			c.AbortWithStatusJSON(
+				http.StatusForbidden,
+				gin.H{"code": http.StatusForbidden, "message": "API keys cannot manage credentials"},
+			)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"spa-api/config"
+	"spa-api/logging"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/sirupsen/logrus"
+)
+
+// Backoff parameters. The first backoffFree failures are not delayed,
+// every next failure doubles the delay up to backoffMax.
+const (
+	backoffFree = 3
+	backoffBase = time.Second
+	backoffMax  = 15 * time.Minute
+)
+
+type attempts struct {
+	start time.Time // beginning of the rate limit window
+	count int       // requests in the current window
+	fails int       // consecutive failures
+	until time.Time // next allowed attempt after a failure
+}
+
+// In-memory storage of attempts by client key.
+type limiter struct {
+	mu      sync.Mutex
+	entries map[string]*attempts
+	ttl     time.Duration
+}
+
+func newLimiter(ttl time.Duration) *limiter {
+	return &limiter{entries: map[string]*attempts{}, ttl: ttl}
+}
+
+// Returns the entry for the key, dropping stale entries of other keys
+// from time to time so the map cannot grow without bound.
+func (l *limiter) get(key string, now time.Time) *attempts {
+	if len(l.entries) > 10000 {
+		for k, v := range l.entries {
+			if now.Sub(v.start) > l.ttl && now.After(v.until) {
+				delete(l.entries, k)
+			}
+		}
+	}
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &attempts{start: now}
+		l.entries[key] = entry
+	}
+	return entry
+}
+
+// Limits the number of requests from one client IP to limit per window.
+// The limit is selected from the current configuration on every
+// request, so reloaded limits apply at once. Return 429 status with
+// Retry-After header when the limit is exceeded.
+func RateLimit(
+	limit func(config.RateLimit) int,
+	window time.Duration,
+) gin.HandlerFunc {
+	l := newLimiter(window)
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		now := time.Now()
+		l.mu.Lock()
+		entry := l.get(c.ClientIP(), now)
+		if now.Sub(entry.start) >= window {
+			entry.start, entry.count = now, 0
+		}
+		entry.count++
+		count, reset := entry.count, entry.start.Add(window)
+		l.mu.Unlock()
+		if count > limit(config.Get().RateLimit) {
+			log.WithFields(logrus.Fields{
+				"IP":    c.ClientIP(),
+				"route": c.FullPath(),
+			}).Warn(logging.F() + "() rate limit exceeded:")
+			tooMany(c, reset.Sub(now))
+			return
+		}
+		c.Next()
+	}
+}
+
+// Delays repeated failed logins by client IP and by username with an
+// exponential backoff. A request is considered failed when the next
+// handlers respond with 401 status, except the request for the second
+// factor after a correct password. A successful one resets the
+// counters.
+func Backoff() gin.HandlerFunc {
+	l := newLimiter(backoffMax)
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		keys := []string{"ip:" + c.ClientIP()}
+		if name := loginName(c); name != "" {
+			keys = append(keys, "user:"+strings.ToLower(name))
+		}
+		now := time.Now()
+		var wait time.Duration
+		l.mu.Lock()
+		for _, key := range keys {
+			entry := l.get(key, now)
+			if d := entry.until.Sub(now); d > wait {
+				wait = d
+			}
+		}
+		l.mu.Unlock()
+		if wait > 0 {
+			log.WithFields(logrus.Fields{
+				"keys": keys,
+				"wait": wait,
+			}).Warn(logging.F() + "() login attempt is delayed:")
+			tooMany(c, wait)
+			return
+		}
+		c.Next()
+		if c.GetBool("totp_required") {
+			return
+		}
+		now = time.Now()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, key := range keys {
+			entry := l.get(key, now)
+			switch c.Writer.Status() {
+			case http.StatusUnauthorized:
+				entry.fails++
+				entry.start = now
+				entry.until = now.Add(backoffDelay(entry.fails))
+			case http.StatusOK:
+				delete(l.entries, key)
+			}
+		}
+	}
+}
+
+// Returns the delay after the specified number of consecutive failures.
+func backoffDelay(fails int) time.Duration {
+	if fails <= backoffFree {
+		return 0
+	}
+	n := float64(fails - backoffFree - 1)
+	delay := time.Duration(float64(backoffBase) * math.Pow(2, n))
+	if delay <= 0 || delay > backoffMax {
+		return backoffMax
+	}
+	return delay
+}
+
+// Reads the username from the login request body and restores the
+// body for the next handlers. Return an empty string if the username
+// cannot be parsed.
+func loginName(c *gin.Context) string {
+	log := logging.Ctx(c.Request.Context())
+	if c.Request.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 1<<16))
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		log.Error(logging.F()+"() body reading error:", err)
+		return ""
+	}
+	switch c.ContentType() {
+	case binding.MIMEJSON:
+		var vals struct{ Username string }
+		if binding.JSON.BindBody(body, &vals) == nil {
+			return vals.Username
+		}
+	case binding.MIMEPOSTForm:
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			return form.Get("Username")
+		}
+	}
+	return ""
+}
+
+func tooMany(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", fmt.Sprintf("%d", seconds))
+	c.AbortWithStatusJSON(
+		http.StatusTooManyRequests,
+		gin.H{"message": fmt.Sprintf(
+			"Too many attempts. Try again in %d seconds.", seconds,
+		)},
+	)
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"spa-api/logging"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Header of the request ID in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// Request IDs of clients and proxies are kept if they are short and
+// safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// Assigns an ID to every request. The ID of the X-Request-ID header is
+// kept, so the lines of a proxy and the service can be matched,
+// otherwise a random one is generated. The ID is returned in the
+// response header and added to the log entries of the request context.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(
+			logging.WithRequestID(c.Request.Context(), id),
+		)
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Logs every request except the skipped paths as a structured entry.
+// The query is not logged, because webtokens may be passed in it.
+func AccessLog(skipPaths ...string) gin.HandlerFunc {
+	skip := map[string]bool{}
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		if skip[c.Request.URL.Path] {
+			return
+		}
+		entry := logging.Ctx(c.Request.Context()).WithFields(logrus.Fields{
+			"status":  c.Writer.Status(),
+			"method":  c.Request.Method,
+			"path":    c.Request.URL.Path,
+			"ip":      c.ClientIP(),
+			"latency": time.Since(start),
+			"bytes":   c.Writer.Size(),
+		})
+		if errs := c.Errors.ByType(gin.ErrorTypePrivate).String(); errs != "" {
+			entry = entry.WithField("errors", errs)
+		}
+		entry.Info("[GIN] request")
+	}
+}
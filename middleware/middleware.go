@@ -1,35 +1,38 @@
 package middleware
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
-	"os"
+	"net/http"
+	"spa-api/config"
 	"spa-api/handlers"
+	"spa-api/keys"
 	"spa-api/logging"
+	"spa-api/metrics"
+	"sync"
 	"time"
 
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/contrib/secure"
+	"github.com/gin-gonic/gin"
+	jwt4 "github.com/golang-jwt/jwt/v4"
 )
 
 var log = logging.Config
 
 // Security parameters
 func Security() secure.Options {
+	settings := config.Get().Security
 	return secure.Options{
-		AllowedHosts:          []string{"127.0.0.1:8080", "ssl.example.com"},
-		SSLRedirect:           false, // false for dev | true for prod
-		SSLHost:               "ssl.example.com",
+		AllowedHosts:          settings.AllowedHosts,
+		SSLRedirect:           settings.SSLRedirect, // false for dev | true for prod
+		SSLHost:               settings.SSLHost,
 		SSLProxyHeaders:       map[string]string{"X-Forwarded-Proto": "http"},
-		STSSeconds:            315360000,
+		STSSeconds:            settings.STSSeconds,
 		STSIncludeSubdomains:  true,
 		FrameDeny:             true,
 		ContentTypeNosniff:    true,
 		BrowserXssFilter:      true,
-		ContentSecurityPolicy: "default-src 'self'",
+		ContentSecurityPolicy: settings.ContentSecurityPolicy,
 	}
 }
 
@@ -38,85 +41,121 @@ func CORS() cors.Config {
 	config := cors.DefaultConfig()
 	config.AllowMethods = []string{"GET", "POST", "OPTIONS"}
 	config.AllowHeaders = append(config.AllowHeaders, "Authorization")
-	config.AllowOrigins = []string{
-		//"http://localhost:3000",
-		//"http://127.0.0.1:3000",
-		"https://ssl.example.com",
-	}
+	config.AllowOriginFunc = allowOrigin
 	return config
 }
 
+// Checks the origin against the current configuration, so reloaded
+// origins apply at once.
+func allowOrigin(origin string) bool {
+	for _, allowed := range config.Get().Security.CORSOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Signing keys of webtokens, loaded by Keys().
+var signingKeys *keys.Set
+
+var keysOnce sync.Once
+
+// gin-jwt/v2 middleware with the rotating signing keys. gin-jwt signs
+// tokens with a single key and without the kid header, so the login
+// handler and the token generator are replaced. Tokens are verified by
+// gin-jwt with the key of the kid header.
+type Tokens struct {
+	jwt.GinJWTMiddleware
+	Keys *keys.Set
+}
+
 // JWT parameters
-func JWT() jwt.GinJWTMiddleware {
+func JWT() Tokens {
 	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
-		Realm:            "Application API",
-		SigningAlgorithm: "RS256", // USE ASYMMETRIC ENCRYPTION ONLY!!!
-		PrivKeyFile:      "keys/priv.pem",
-		PubKeyFile:       "keys/pub.pem",
-		Timeout:          time.Hour,
-		MaxRefresh:       time.Hour,
-		PayloadFunc:      handlers.Payload,
-		Authenticator:    handlers.LogIn,
-		TokenLookup:      "header: Authorization, query: token, cookie: jwt",
-		TokenHeadName:    "Bearer",
-		TimeFunc:         time.Now,
+		Realm:         "Application API",
+		KeyFunc:       signingKeys.KeyFunc,
+		Timeout:       config.Get().JWT.Timeout,
+		MaxRefresh:    config.Get().JWT.MaxRefresh,
+		PayloadFunc:   handlers.Payload,
+		Authenticator: handlers.LogIn,
+		LoginResponse: handlers.LoginResponse,
+		TokenLookup:   "header: Authorization, query: token, cookie: jwt",
+		TokenHeadName: "Bearer",
+		TimeFunc:      time.Now,
 	})
 	if err != nil {
 		log.Fatal(logging.F()+"() error:", err)
 	}
-	return *authMiddleware
+	return Tokens{GinJWTMiddleware: *authMiddleware, Keys: signingKeys}
 }
 
-// Generates middleware key files for the asymmetric algorithm (RS256),
-// if they do not exist.
-func Keys() {
-	check := 0
-	_, err := os.Stat("keys/priv.pem")
+// Creates a signed webtoken with the payload of the data.
+func (t *Tokens) TokenGenerator(data interface{}) (string, time.Time, error) {
+	claims := jwt4.MapClaims{}
+	for key, value := range t.PayloadFunc(data) {
+		claims[key] = value
+	}
+	now := t.TimeFunc()
+	expire := now.Add(t.Timeout)
+	claims["exp"] = expire.Unix()
+	// Microseconds, so a login right after the revocation of all tokens
+	// is not revoked too.
+	claims["orig_iat"] = float64(now.UnixMicro()) / 1e6
+	token, err := t.Keys.Sign(claims)
 	if err != nil {
-		if os.IsNotExist(err) {
-			check++
-		} else {
-			log.Error(logging.F()+"() priv.pem checking error:", err)
-		}
+		return "", time.Time{}, err
 	}
-	_, err = os.Stat("keys/pub.pem")
+	return token, expire, nil
+}
+
+// Login handler with the same responses as the gin-jwt/v2 one.
+func (t *Tokens) LoginHandler(c *gin.Context) {
+	log := logging.Ctx(c.Request.Context())
+	data, err := t.Authenticator(c)
 	if err != nil {
-		if os.IsNotExist(err) {
-			check++
-		} else {
-			log.Error(logging.F()+"() pub.pem checking error:", err)
-		}
+		metrics.Login(err)
+		t.Unauthorized(
+			c,
+			http.StatusUnauthorized,
+			t.HTTPStatusMessageFunc(err, c),
+		)
+		return
 	}
-	if check == 0 {
+	token, expire, err := t.TokenGenerator(data)
+	if err != nil {
+		log.Error(logging.F()+"() cannot sign token:", err)
+		metrics.Login(err)
+		t.Unauthorized(
+			c,
+			http.StatusUnauthorized,
+			t.HTTPStatusMessageFunc(jwt.ErrFailedTokenCreation, c),
+		)
 		return
-	} else {
-		os.Remove("keys/priv.pem")
-		os.Remove("keys/pub.pem")
-		priv, err := rsa.GenerateKey(rand.Reader, 4096)
-		if err != nil {
-			log.Error(logging.F()+"() cannot generate privave key:", err)
-			return
-		}
-		privBytes := x509.MarshalPKCS1PrivateKey(priv)
-		privPEM := pem.EncodeToMemory(
-			&pem.Block{
-				Type:  "RSA PRIVATE KEY",
-				Bytes: privBytes,
-			},
+	}
+	metrics.Login(nil)
+	t.LoginResponse(c, http.StatusOK, token, expire)
+}
+
+// Loads the webtoken signing keys from the key directory and starts
+// their rotation. The key rotation is the key lifetime (no rotation if
+// zero) and the key overlap is the time of publishing before and after
+// the key signs.
+func Keys() {
+	keysOnce.Do(func() {
+		settings := config.Get().JWT
+		var err error
+		signingKeys, err = keys.Load(
+			settings.KeyDir,
+			settings.KeyAlgorithm,
+			settings.KeyRotation,
+			settings.KeyOverlap,
 		)
-		pub := &priv.PublicKey
-		pubBytes, err := x509.MarshalPKIXPublicKey(pub)
 		if err != nil {
-			log.Error(logging.F()+"() cannot convert public key to PEM:", err)
-			return
+			log.Fatal(logging.F()+"() cannot load signing keys:", err)
 		}
-		pubPEM := pem.EncodeToMemory(
-			&pem.Block{
-				Type:  "RSA PUBLIC KEY",
-				Bytes: pubBytes,
-			},
-		)
-		os.WriteFile("keys/priv.pem", privPEM, 0700)
-		os.WriteFile("keys/pub.pem", pubPEM, 0755)
-	}
+		if settings.KeyRotation > 0 {
+			go signingKeys.Run(time.Minute, nil)
+		}
+	})
 }
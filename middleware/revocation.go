@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	db "spa-api/database"
+	"spa-api/handlers"
+	"spa-api/logging"
+	"time"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Rejects access tokens of disabled users and tokens that were revoked
+// by logout (jti denylist), belong to a revoked session or were issued
+// before "log out all sessions" of the user. Must follow the gin-jwt/v2 middleware.
+func Revocation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.Ctx(c.Request.Context())
+		claims := jwt.ExtractClaims(c)
+		session, err := handlers.CheckToken(claims)
+		if err != nil {
+			if err != handlers.ErrTokenRevoked {
+				log.WithFields(logrus.Fields{
+					"ID": claims["id"],
+				}).Warn(logging.F()+"() token of unknown user:", err)
+			}
+			revoked(c)
+			return
+		}
+		// Activity is saved no more than once a minute.
+		if session != nil && time.Since(session.LastSeen) > time.Minute {
+			db.C.Model(session).Updates(map[string]interface{}{
+				"last_seen": time.Now(),
+				"ip":        c.ClientIP(),
+			})
+		}
+		c.Next()
+	}
+}
+
+func revoked(c *gin.Context) {
+	c.AbortWithStatusJSON(
+		http.StatusUnauthorized,
+		gin.H{"code": http.StatusUnauthorized, "message": "token is revoked"},
+	)
+}
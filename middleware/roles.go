@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+	"spa-api/models"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+)
+
+// Allows the route only for the listed roles of the role claim.
+// Webtokens issued before roles were introduced have the user role.
+func Role(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, ok := jwt.ExtractClaims(c)["role"].(string)
+		if !ok {
+			role = models.RoleUser
+		}
+		for _, r := range roles {
+			if r == role {
+				c.Next()
+				return
+			}
+		}
+		c.AbortWithStatusJSON(
+			http.StatusForbidden,
+			gin.H{"code": http.StatusForbidden, "message": "role does not allow this operation"},
+		)
+	}
+}
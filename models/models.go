@@ -6,12 +6,42 @@ import (
 	"gorm.io/gorm"
 )
 
+// Sources of user accounts.
+const (
+	ProviderLocal = "local"
+	ProviderLDAP  = "ldap"
+	ProviderOIDC  = "oidc"
+)
+
+// Roles of users. Read-only users can only list and download their
+// files, admins also have access to the "/api/admin" routes.
+const (
+	RoleAdmin    = "admin"
+	RoleUser     = "user"
+	RoleReadOnly = "read-only"
+)
+
 type User struct {
 	gorm.Model
 	ID       uint   `gorm:"primaryKey"`
 	Username string `gorm:"unique;not null"`
 	Password string `gorm:"not null"`
-	Files    []File
+	// Optional mail address, uploads are blocked until it is verified.
+	Email         string `gorm:"index"`
+	EmailVerified bool   `gorm:"not null;default:false"`
+	Provider      string `gorm:"not null;default:local"`
+	Role          string `gorm:"not null;default:user"`
+	Disabled      bool   `gorm:"not null;default:false"`
+	Quota         int64  `gorm:"not null;default:0"` // bytes, 0 is the default quota
+	FailedLogins  int    `gorm:"not null;default:0"`
+	LockedUntil   time.Time
+	TOTPSecret    string
+	TOTPEnabled   bool  `gorm:"not null;default:false"`
+	TOTPStep      int64 `gorm:"not null;default:0"`
+	// Tokens issued before this moment are rejected ("log out all
+	// sessions").
+	TokensValidAfter time.Time
+	Files            []File
 }
 
 type File struct {
@@ -25,3 +55,178 @@ type File struct {
 	Date      time.Time `gorm:"not null"`
 	Size      int64     `gorm:"not null"`
 }
+
+// Audit entry of a temporary account lockout after too many failed
+// login attempts.
+type Lockout struct {
+	gorm.Model
+	ID     uint      `gorm:"primaryKey"`
+	UserID uint      `gorm:"not null;index"`
+	IP     string    `gorm:"not null"`
+	Until  time.Time `gorm:"not null"`
+}
+
+// Hash of a single-use two-factor recovery code.
+type RecoveryCode struct {
+	gorm.Model
+	ID     uint   `gorm:"primaryKey"`
+	UserID uint   `gorm:"not null;index"`
+	Hash   string `gorm:"not null"`
+}
+
+// Hash of a rotating refresh token. A token is revoked after a single
+// use and replaced by a new one.
+type RefreshToken struct {
+	gorm.Model
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	SessionID uint      `gorm:"index"`
+	Hash      string    `gorm:"unique;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	Revoked   bool      `gorm:"not null;default:false"`
+}
+
+// Login of the user from a device. Access and refresh tokens issued
+// for the session are rejected after it is revoked.
+type Session struct {
+	gorm.Model
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	UserAgent string    `gorm:"not null"`
+	IP        string    `gorm:"not null"`
+	LastSeen  time.Time `gorm:"not null"`
+	Revoked   bool      `gorm:"not null;default:false"`
+}
+
+// Denylist entry of an access token ID (jti claim). Entries are needed
+// only until the token expires.
+type RevokedToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	JTI       string    `gorm:"unique;not null"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// Scopes of personal API keys. Web logins always have the full scope.
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeFull   = "full"
+)
+
+// Long-lived personal API key for scripts. Only the hash of the key is
+// stored, Prefix helps the user to recognize the key.
+type APIKey struct {
+	gorm.Model
+	ID       uint   `gorm:"primaryKey"`
+	UserID   uint   `gorm:"not null;index"`
+	Name     string `gorm:"not null"`
+	Prefix   string `gorm:"not null"`
+	Hash     string `gorm:"unique;not null"`
+	Scope    string `gorm:"not null"`
+	LastUsed time.Time
+}
+
+// External OpenID Connect identity linked to the user.
+type Identity struct {
+	gorm.Model
+	ID      uint   `gorm:"primaryKey"`
+	UserID  uint   `gorm:"not null;index"`
+	Issuer  string `gorm:"not null;uniqueIndex:idx_identity"`
+	Subject string `gorm:"not null;uniqueIndex:idx_identity"`
+}
+
+// Kinds of single-use user tokens.
+const (
+	TokenReset  = "reset"
+	TokenVerify = "verify"
+)
+
+// Hash of a single-use, time-limited token sent to the user for the
+// password reset or the mail address verification.
+type UserToken struct {
+	gorm.Model
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	Kind      string    `gorm:"not null"`
+	Hash      string    `gorm:"unique;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// Actions of the audit log.
+const (
+	ActionLogin    = "login"
+	ActionSignUp   = "signup"
+	ActionUpload   = "upload"
+	ActionDownload = "download"
+	ActionRename   = "rename"
+	ActionDelete   = "delete"
+)
+
+// Outcomes of audited actions.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Audit log entry of a user action. Entries are not changed and are
+// kept when the account is deleted, so the actor is stored by ID and
+// name instead of a UserID.
+type AuditEvent struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"not null;index"`
+	ActorID   uint      `gorm:"not null;index"` // 0 if the user is unknown
+	Actor     string    `gorm:"not null"`       // username
+	Action    string    `gorm:"not null;index"`
+	FileID    uint      `gorm:"not null;default:0"` // target file
+	Target    string    `gorm:"not null"`           // name of the target file
+	IP        string    `gorm:"not null"`
+	UserAgent string    `gorm:"not null"`
+	Outcome   string    `gorm:"not null"`
+	Detail    string    `gorm:"not null"` // reason of a failure
+	RequestID string    `gorm:"not null"`
+}
+
+// Endpoint notified about file events. Webhooks of UserID 0 are
+// created by admins and receive the events of all users. The secret
+// signs the payloads, so it is stored as is.
+type Webhook struct {
+	gorm.Model
+	ID     uint   `gorm:"primaryKey"`
+	UserID uint   `gorm:"not null;index"`
+	URL    string `gorm:"not null"`
+	Secret string `gorm:"not null"`
+	Events string `gorm:"not null"` // comma-separated event types, all if empty
+}
+
+// States of webhook deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Outbox entry of a webhook payload and the log of its delivery.
+// Pending entries are sent after NextAttempt, so they survive restarts.
+type WebhookDelivery struct {
+	ID           uint      `gorm:"primaryKey"`
+	CreatedAt    time.Time `gorm:"not null"`
+	WebhookID    uint      `gorm:"not null;index"`
+	Event        string    `gorm:"not null"`
+	Payload      string    `gorm:"not null"`
+	Status       string    `gorm:"not null;index:idx_delivery_due"`
+	Attempts     int       `gorm:"not null;default:0"`
+	NextAttempt  time.Time `gorm:"not null;index:idx_delivery_due"`
+	ResponseCode int       `gorm:"not null;default:0"` // of the last attempt
+	Error        string    `gorm:"not null"`           // of the last attempt
+	DeliveredAt  time.Time
+}
+
+// Returns all models for the database migration.
+func Tables() []interface{} {
+	return []interface{}{
+		&User{}, &File{}, &Lockout{}, &RecoveryCode{},
+		&RefreshToken{}, &RevokedToken{}, &Session{}, &APIKey{},
+		&Identity{}, &UserToken{}, &AuditEvent{}, &Webhook{},
+		&WebhookDelivery{},
+	}
+}
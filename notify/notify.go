@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"spa-api/config"
+	"spa-api/logging"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Config
+
+var ErrHeaderInjection = errors.New("line break in the message header")
+
+// Delivery of messages to users.
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+// Returns the SMTP notifier of the mail settings or the log notifier if
+// the SMTP host is empty.
+func New(c config.Mail) Notifier {
+	if c.SMTPHost == "" {
+		return Log{}
+	}
+	return &SMTP{
+		Host:     c.SMTPHost,
+		Port:     c.SMTPPort,
+		Username: c.SMTPUser,
+		Password: c.SMTPPassword,
+		From:     c.From,
+	}
+}
+
+// Plain text mail through an SMTP server. The connection is upgraded
+// by STARTTLS if the server supports it.
+type SMTP struct {
+	Host     string
+	Port     string
+	Username string // no authentication if empty
+	Password string
+	From     string
+}
+
+func (s *SMTP) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return ErrHeaderInjection
+	}
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\n"+
+			"MIME-Version: 1.0\r\n"+
+			"Content-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		s.From, to, subject, body,
+	)
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	return smtp.SendMail(
+		net.JoinHostPort(s.Host, s.Port),
+		auth,
+		s.From,
+		[]string{to},
+		[]byte(msg),
+	)
+}
+
+// Writes messages to the log instead of sending. For development only,
+// the messages contain secret links.
+type Log struct{}
+
+func (Log) Send(to, subject, body string) error {
+	log.WithFields(logrus.Fields{
+		"to":      to,
+		"subject": subject,
+		"body":    body,
+	}).Warn(logging.F() + "() SMTP is not configured, message:")
+	return nil
+}
+
+// Message saved by the Fake notifier.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Keeps messages in memory for tests.
+type Fake struct {
+	Err      error // returned by Send() instead of saving the message
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (f *Fake) Send(to, subject, body string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.messages = append(f.messages, Message{to, subject, body})
+	return nil
+}
+
+// Returns the messages sent to the address.
+func (f *Fake) Messages(to string) []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	list := []Message{}
+	for _, m := range f.messages {
+		if m.To == to {
+			list = append(list, m)
+		}
+	}
+	return list
+}
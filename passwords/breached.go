@@ -0,0 +1,131 @@
+package passwords
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Length of the hash prefix of a k-anonymity range.
+const PrefixLength = 5
+
+// Offline list of breached password hashes in the Have I Been Pwned
+// format: sorted lines of uppercase SHA-1 hashes with a count
+// ("HASH:COUNT"). Like the range API, a lookup reads only the lines of
+// the hash prefix, so the list is not loaded into memory.
+type Breached struct {
+	file *os.File
+	size int64
+}
+
+func OpenBreached(path string) (*Breached, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Breached{file: file, size: info.Size()}, nil
+}
+
+func (b *Breached) Close() error {
+	return b.file.Close()
+}
+
+// Returns how many times the password appeared in breaches, 0 if it is
+// not in the list.
+func (b *Breached) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes, err := b.Range(hash[:PrefixLength])
+	if err != nil {
+		return 0, err
+	}
+	return suffixes[hash[PrefixLength:]], nil
+}
+
+// Returns the hash suffixes with counts of the prefix.
+func (b *Breached) Range(prefix string) (map[string]int, error) {
+	prefix = strings.ToUpper(prefix)
+	// Binary search of the first line not less than the prefix.
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		_, line, err := b.line(mid)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == io.EOF || key(line) >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	suffixes := map[string]int{}
+	for offset := lo; ; {
+		next, line, err := b.line(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, prefix) {
+			break
+		}
+		hash, count, _ := strings.Cut(line, ":")
+		n, _ := strconv.Atoi(count)
+		suffixes[hash[len(prefix):]] = n
+		offset = next
+	}
+	return suffixes, nil
+}
+
+func key(line string) string {
+	if len(line) < PrefixLength {
+		return line
+	}
+	return line[:PrefixLength]
+}
+
+// Returns the first line that starts at the offset or later and the
+// offset after it.
+func (b *Breached) line(offset int64) (int64, string, error) {
+	if offset > 0 {
+		// A line starts after the line break before the offset.
+		offset--
+		buf := make([]byte, 128)
+		for {
+			n, err := b.file.ReadAt(buf, offset)
+			if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+				offset += int64(i) + 1
+				break
+			}
+			if err != nil {
+				return 0, "", err
+			}
+			offset += int64(n)
+		}
+	}
+	buf := make([]byte, 128)
+	n, err := b.file.ReadAt(buf, offset)
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, "", err
+	}
+	end := bytes.IndexByte(buf[:n], '\n')
+	if end < 0 {
+		end = n
+	}
+	line := strings.ToUpper(strings.TrimSpace(string(buf[:end])))
+	return offset + int64(end) + 1, line, nil
+}
@@ -0,0 +1,130 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"spa-api/config"
+	"spa-api/logging"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+var ErrHashFormat = errors.New("unknown password hash format")
+
+// Hashing of passwords for the database. New hashes use Algorithm with
+// the current parameters, hashes of both algorithms are verified. The
+// argon2id parameters are encoded in the hash (PHC string format).
+type Hasher struct {
+	Algorithm string
+	Memory    uint32 // argon2id memory in KiB
+	Time      uint32 // argon2id iterations
+	Threads   uint8  // argon2id parallelism
+	KeyLength uint32
+	Cost      int // bcrypt cost
+}
+
+// Returns the hasher of the password settings. The default is argon2id
+// with 64 MiB of memory, 3 iterations and 2 threads.
+func NewHasher(c config.Password) *Hasher {
+	return &Hasher{
+		Algorithm: c.Hasher,
+		Memory:    c.Argon2Memory,
+		Time:      c.Argon2Time,
+		Threads:   c.Argon2Threads,
+		KeyLength: 32,
+		Cost:      c.BcryptCost,
+	}
+}
+
+// Returns the encoded hash of the password with a random salt.
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+		return string(hash), err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(
+		[]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLength,
+	)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Reports whether the password matches the encoded hash and whether the
+// hash should be replaced, because it uses another algorithm or
+// outdated parameters.
+func (h *Hasher) Verify(hash, password string) (bool, bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			log.Error(logging.F()+"() invalid hash:", err)
+			return false, false
+		}
+		other := argon2.IDKey(
+			[]byte(password), salt,
+			params.Time, params.Memory, params.Threads, uint32(len(key)),
+		)
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, false
+		}
+		rehash := h.Algorithm != Argon2id ||
+			params.Memory != h.Memory ||
+			params.Time != h.Time ||
+			params.Threads != h.Threads ||
+			uint32(len(key)) != h.KeyLength
+		return true, rehash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		return false, false
+	}
+	cost, _ := bcrypt.Cost([]byte(hash))
+	return true, h.Algorithm != Bcrypt || cost < h.Cost
+}
+
+func decodeArgon2id(hash string) (*Hasher, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, ErrHashFormat
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrHashFormat
+	}
+	params := &Hasher{Algorithm: Argon2id}
+	_, err = fmt.Sscanf(
+		parts[3], "m=%d,t=%d,p=%d",
+		&params.Memory, &params.Time, &params.Threads,
+	)
+	if err != nil || params.Time == 0 || params.Threads == 0 {
+		return nil, nil, nil, ErrHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrHashFormat
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,137 @@
+package passwords
+
+import (
+	"errors"
+	"fmt"
+	"spa-api/config"
+	"spa-api/logging"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var log = logging.Config
+
+// Password requirements. The zero value accepts any password.
+type Policy struct {
+	MinLength int  // characters
+	MaxLength int  // characters, 0 is unlimited
+	MaxBytes  int  // UTF-8 bytes, 0 is unlimited
+	Classes   int  // required classes of lower, upper, digit and other
+	ASCIIOnly bool // printable ASCII characters only
+	Normalize bool // Unicode NFKC normalization before checks and hashing
+	MinScore  int  // minimal Strength() score, 0 disables the check
+	Breached  *Breached
+}
+
+var (
+	ErrControl = errors.New("The password must not contain control characters.")
+	ErrASCII   = errors.New("The password must contain only ASCII characters.")
+	ErrWeak    = errors.New("The password is too easy to guess. Add more words or characters.")
+	ErrBreach  = errors.New("The password has appeared in a data breach. Choose another password.")
+)
+
+// Returns the policy of the password settings and opens the breached
+// password list. The defaults are 16 to 72 printable ASCII characters
+// of all four classes. bcrypt hashes only the first 72 bytes, so longer
+// passwords are rejected with it whatever the character limit is.
+func NewPolicy(c config.Password) (*Policy, error) {
+	p := &Policy{
+		MinLength: c.MinLength,
+		MaxLength: c.MaxLength,
+		Classes:   c.Classes,
+		ASCIIOnly: c.ASCIIOnly,
+		Normalize: c.Normalize,
+		MinScore:  c.MinScore,
+	}
+	if c.Hasher == Bcrypt {
+		p.MaxBytes = 72
+	}
+	if c.BreachedFile != "" {
+		b, err := OpenBreached(c.BreachedFile)
+		if err != nil {
+			return nil, err
+		}
+		p.Breached = b
+	}
+	return p, nil
+}
+
+// Returns the form of the password for checks and hashing.
+func (p *Policy) Prepare(password string) string {
+	if p.Normalize {
+		return norm.NFKC.String(password)
+	}
+	return password
+}
+
+// Checks the password against the policy. User inputs such as the
+// username lower the strength score if the password contains them.
+// Returns an error with a message for the user if the password does
+// not match the requirements.
+func (p *Policy) Check(password string, userInputs ...string) error {
+	password = p.Prepare(password)
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf(
+			"The password must be at least %d characters long.",
+			p.MinLength,
+		)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf(
+			"The password must be at most %d characters long.",
+			p.MaxLength,
+		)
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		return fmt.Errorf(
+			"The password must be at most %d bytes long.",
+			p.MaxBytes,
+		)
+	}
+	var lower, upper, digit, other bool
+	for _, char := range password {
+		switch {
+		case char == utf8.RuneError || unicode.IsControl(char):
+			return ErrControl
+		case p.ASCIIOnly && char > unicode.MaxASCII:
+			return ErrASCII
+		case unicode.IsLower(char):
+			lower = true
+		case unicode.IsUpper(char):
+			upper = true
+		case unicode.IsDigit(char):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			classes++
+		}
+	}
+	if classes < p.Classes {
+		return fmt.Errorf(
+			"The password must contain at least %d of: a lowercase letter, "+
+				"an uppercase letter, a number and a special character.",
+			p.Classes,
+		)
+	}
+	if p.MinScore > 0 && Strength(password, userInputs...) < p.MinScore {
+		return ErrWeak
+	}
+	if p.Breached != nil {
+		count, err := p.Breached.Count(password)
+		if err != nil {
+			// An unreadable list must not block all registrations.
+			log.Error(logging.F()+"() breached password lookup error:", err)
+		} else if count > 0 {
+			return ErrBreach
+		}
+	}
+	return nil
+}
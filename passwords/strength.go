@@ -0,0 +1,172 @@
+package passwords
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Most common passwords and words of passwords, by rank.
+var common = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin",
+	"monkey", "dragon", "football", "baseball", "iloveyou", "master",
+	"sunshine", "princess", "shadow", "superman", "michael", "secret",
+	"login", "trustno1", "starwars", "whatever", "freedom", "hello",
+	"charlie", "donald", "batman", "access", "passw0rd", "computer",
+	"summer", "winter", "spring", "autumn", "love", "god", "money",
+	"soccer", "hockey", "killer", "pepper", "ginger", "cookie",
+	"flower", "hunter", "ranger", "buster", "thomas", "jordan",
+	"harley", "robert", "daniel", "andrew", "joshua", "matthew",
+	"jennifer", "jessica", "ashley", "amanda", "nicole", "hannah",
+	"orange", "banana", "cheese", "chocolate", "purple", "silver",
+	"golden", "diamond", "internet", "service", "server", "default",
+	"changeme", "example", "company", "office", "user", "test",
+}
+
+var keyboard = []string{
+	"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm",
+	"qazwsxedc", "1qaz2wsx3edc",
+}
+
+var leet = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "3", "e", "6", "g", "1", "i",
+	"!", "i", "0", "o", "5", "s", "$", "s", "7", "t", "2", "z",
+)
+
+// Guesses of a bruteforce attack per character.
+const bruteforce = 10
+
+const maxSegment = 32
+
+// Returns the strength score of the password from 0 (too guessable) to
+// 4 (very unguessable) by the estimated number of guesses. Like
+// zxcvbn, the password is split into the cheapest sequence of common
+// words, user inputs, keyboard runs, sequences, repeats and bruteforce
+// characters.
+func Strength(password string, userInputs ...string) int {
+	guesses := Guesses(password, userInputs...)
+	switch {
+	case guesses < 1e3:
+		return 0
+	case guesses < 1e6:
+		return 1
+	case guesses < 1e8:
+		return 2
+	case guesses < 1e10:
+		return 3
+	}
+	return 4
+}
+
+// Returns the estimated number of guesses to find the password.
+func Guesses(password string, userInputs ...string) float64 {
+	chars := []rune(strings.ToLower(password))
+	n := len(chars)
+	if n == 0 {
+		return 1
+	}
+	words := map[string]int{}
+	for i, w := range common {
+		words[w] = i + 1
+	}
+	for _, w := range userInputs {
+		w = strings.ToLower(w)
+		if utf8.RuneCountInString(w) >= 3 {
+			words[w] = 1
+		}
+	}
+	// best[i] is the minimal log10 of guesses of the first i characters
+	// with count[i] matched patterns.
+	best := make([]float64, n+1)
+	count := make([]int, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = math.Inf(1)
+	}
+	for end := 1; end <= n; end++ {
+		// Patterns are short, longer segments are bruteforce anyway.
+		start := end - maxSegment
+		if start < 0 {
+			start = 0
+		}
+		for ; start < end; start++ {
+			g := segment(chars[start:end], words)
+			c := count[start] + 1
+			cost := best[start] + math.Log10(g) + math.Log10(float64(c))
+			if cost < best[end] {
+				best[end] = cost
+				count[end] = c
+			}
+		}
+	}
+	return math.Pow(10, best[n])
+}
+
+// Returns the guesses of the segment as a single pattern or as
+// bruteforce characters.
+func segment(chars []rune, words map[string]int) float64 {
+	n := len(chars)
+	s := string(chars)
+	if n == 1 {
+		return bruteforce
+	}
+	if rank, ok := words[s]; ok {
+		return float64(rank)
+	}
+	if rank, ok := words[leet.Replace(s)]; ok && n >= 4 {
+		return float64(rank) * 2
+	}
+	if n < 3 {
+		return math.Pow(bruteforce, float64(n))
+	}
+	if repeat(chars) {
+		return bruteforce * float64(n)
+	}
+	if sequence(chars) {
+		return 4 * float64(n)
+	}
+	if n >= 4 && onKeyboard(s) {
+		return 6 * float64(n)
+	}
+	return math.Pow(bruteforce, float64(n))
+}
+
+func repeat(chars []rune) bool {
+	for _, c := range chars[1:] {
+		if c != chars[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports whether the characters are a run with a step of 1 or -1, for
+// example "abcd" or "4321".
+func sequence(chars []rune) bool {
+	step := chars[1] - chars[0]
+	if step != 1 && step != -1 {
+		return false
+	}
+	for i := 2; i < len(chars); i++ {
+		if chars[i]-chars[i-1] != step {
+			return false
+		}
+	}
+	return true
+}
+
+func onKeyboard(s string) bool {
+	for _, row := range keyboard {
+		if strings.Contains(row, s) || strings.Contains(reverse(row), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func reverse(s string) string {
+	chars := []rune(s)
+	for i, j := 0, len(chars)-1; i < j; i, j = i+1, j-1 {
+		chars[i], chars[j] = chars[j], chars[i]
+	}
+	return string(chars)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"spa-api/certs"
+	"spa-api/config"
+	db "spa-api/database"
+	"spa-api/events"
+	"spa-api/handlers"
+	"spa-api/logging"
+	"spa-api/webhooks"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Serves the requests until SIGINT or SIGTERM. Then new connections are
+// refused and the requests in progress, such as file transfers, get the
+// shutdown timeout to complete before their connections are closed.
+// The handlers of aborted requests and the webhook deliveries are
+// waited for, then partial files of interrupted uploads are deleted
+// and the database is closed. A second signal stops the process at
+// once. The internal handler serves the metrics listener.
+func serve(handler, internal http.Handler, cfg *config.Config) {
+	settings := cfg.Server
+	errorLog := stdlog.New(log.WriterLevel(logrus.ErrorLevel), "", 0)
+	var requests tracker
+	server := &http.Server{
+		Addr:              settings.Addr,
+		Handler:           requests.Handler(handler),
+		ReadHeaderTimeout: settings.ReadHeaderTimeout,
+		ReadTimeout:       settings.ReadTimeout,
+		WriteTimeout:      settings.WriteTimeout,
+		IdleTimeout:       settings.IdleTimeout,
+		ErrorLog:          errorLog,
+	}
+	servers := []*http.Server{server}
+	errs := make(chan error, 3)
+	stop := make(chan struct{})
+	webhooksDone := make(chan struct{})
+	go webhooks.Run(time.Second, stop, webhooksDone)
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := newTLSConfig(cfg.TLS, stop)
+		if err != nil {
+			log.Fatal(logging.F()+"() TLS error:", err)
+		}
+		server.TLSConfig = tlsConfig
+		go func() {
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+	} else {
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	if cfg.TLS.RedirectAddr != "" {
+		redirect := &http.Server{
+			Addr:              cfg.TLS.RedirectAddr,
+			Handler:           redirectHTTPS(settings.Addr, cfg.Security.SSLHost),
+			ReadHeaderTimeout: settings.ReadHeaderTimeout,
+			IdleTimeout:       settings.IdleTimeout,
+			ErrorLog:          errorLog,
+		}
+		servers = append(servers, redirect)
+		go func() {
+			errs <- redirect.ListenAndServe()
+		}()
+	}
+	if settings.MetricsAddr != "" {
+		metricsServer := &http.Server{
+			Addr:              settings.MetricsAddr,
+			Handler:           requests.Handler(internal),
+			ReadHeaderTimeout: settings.ReadHeaderTimeout,
+			IdleTimeout:       settings.IdleTimeout,
+			ErrorLog:          errorLog,
+		}
+		servers = append(servers, metricsServer)
+		go func() {
+			errs <- metricsServer.ListenAndServe()
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		log.Fatal(logging.F()+"() server error:", err)
+	case sig := <-signals:
+		log.WithFields(logrus.Fields{
+			"signal":  sig,
+			"timeout": settings.ShutdownTimeout,
+		}).Info(logging.F() + "() shutting down:")
+	}
+	signal.Stop(signals)
+	close(stop)
+	// Event streams never complete by themselves.
+	events.Close()
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		settings.ShutdownTimeout,
+	)
+	defer cancel()
+	// The redirect and metrics listeners have no long requests, they
+	// stop first.
+	for i := len(servers) - 1; i >= 0; i-- {
+		if err := servers[i].Shutdown(ctx); err != nil {
+			log.Warn(logging.F()+"() requests in progress are aborted:", err)
+			servers[i].Close()
+		}
+	}
+	// Close() does not wait for the handlers of the closed connections.
+	requests.Wait()
+	<-webhooksDone
+	handlers.CleanPartialUploads()
+	db.Close()
+	log.Info(logging.F() + "() server stopped")
+}
+
+// Counts the requests in progress, so the shutdown can wait for their
+// handlers. Requests that start after Wait() are refused.
+type tracker struct {
+	mu      sync.Mutex
+	closed  bool
+	handled sync.WaitGroup
+}
+
+// Returns the handler that counts its requests.
+func (t *tracker) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		t.handled.Add(1)
+		t.mu.Unlock()
+		defer t.handled.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Refuses new requests and waits for the requests in progress.
+func (t *tracker) Wait() {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.handled.Wait()
+}
+
+// Returns the TLS settings of the server. The certificate is checked
+// for changes every minute until the stop channel is closed. Client
+// certificates are verified by the CA file if client_auth is optional
+// or required.
+func newTLSConfig(settings config.TLS, stop <-chan struct{}) (*tls.Config, error) {
+	certificate, err := certs.Load(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	go certificate.Run(time.Minute, stop)
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificate.GetCertificate,
+	}
+	switch settings.ClientAuth {
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return tlsConfig, nil
+	}
+	tlsConfig.ClientCAs, err = certs.CAPool(settings.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig, nil
+}
+
+// Redirects plain HTTP requests to the same path on the HTTPS listener.
+// The host is the SSL host of the security settings, or the host of the
+// request with the port of the HTTPS listener.
+func redirectHTTPS(addr, sslHost string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := sslHost
+		if host == "" {
+			host = r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if port != "443" {
+				host = net.JoinHostPort(host, port)
+			}
+		}
+		target := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
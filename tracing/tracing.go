@@ -0,0 +1,176 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"spa-api/config"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer of the service spans. It uses the provider set by Start(), the
+// spans are dropped until then.
+var tracer = otel.Tracer("spa-api")
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+}
+
+// Creates the exporter of the settings and starts the tracing. Returns
+// the function that exports the remaining spans and stops it.
+func Init(c config.Tracing) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case "otlp":
+		var endpoint *url.URL
+		endpoint, err = url.Parse(c.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+		if endpoint.Scheme == "http" {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		if endpoint.Path != "" && endpoint.Path != "/" {
+			options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+		}
+		exporter, err = otlptracehttp.New(context.Background(), options...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return func(context.Context) error { return nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := Start(exporter, c)
+	return provider.Shutdown, nil
+}
+
+// Sets the global tracer provider that exports the spans in batches.
+// Traces continue the sampling decision of their parent.
+func Start(exporter sdktrace.SpanExporter, c config.Tracing) *sdktrace.TracerProvider {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(c.SampleRatio),
+		)),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(c.ServiceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+// Starts a span of every request except the skipped paths. The trace
+// context of the request headers is continued and the span is the
+// parent of the spans of the handlers, which get it from the request
+// context.
+func Middleware(skipPaths ...string) gin.HandlerFunc {
+	skip := map[string]bool{}
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+	return func(c *gin.Context) {
+		if skip[c.Request.URL.Path] {
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(
+			c.Request.Context(),
+			propagation.HeaderCarrier(c.Request.Header),
+		)
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = c.Request.Method
+		}
+		ctx, span := tracer.Start(
+			ctx,
+			name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// Records the finished SQL statement of the operation as a span of the
+// request in the context. The statement must not contain bound values.
+// Statements without a traced request are not recorded.
+func Query(
+	ctx context.Context,
+	begin time.Time,
+	operation, sql string,
+	rows int64,
+	err error,
+) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	_, span := tracer.Start(
+		ctx,
+		operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(begin),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatement(sql),
+			attribute.Int64("db.rows_affected", rows),
+		),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Starts a span of a file operation of the storage. The caller ends it
+// with End().
+func Storage(ctx context.Context, name, path string) (context.Context, trace.Span) {
+	return tracer.Start(
+		ctx,
+		"storage."+name,
+		trace.WithAttributes(attribute.String("file.path", path)),
+	)
+}
+
+// Ends the span and records the error if the operation failed.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
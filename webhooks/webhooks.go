@@ -0,0 +1,334 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"spa-api/config"
+	db "spa-api/database"
+	"spa-api/events"
+	"spa-api/logging"
+	"spa-api/metrics"
+	"spa-api/models"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var log = logging.Config
+
+// Headers of a delivery request.
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderDelivery  = "X-Webhook-Delivery"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Deliveries sent by one pass of Deliver() and at the same time.
+const (
+	batch   = 100
+	workers = 8
+)
+
+var (
+	ErrPrivateAddress = errors.New("private network address")
+	ErrStatus         = errors.New("unexpected response status")
+)
+
+// Event types a webhook can subscribe to.
+var Events = []string{events.FileCreated, events.FileRenamed, events.FileDeleted}
+
+// Body of a delivery request.
+type Payload struct {
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	UserID uint      `json:"user_id"`
+	File   File      `json:"file"`
+}
+
+// File of the event without its storage path.
+type File struct {
+	ID        uint      `json:"id"`
+	Name      string    `json:"name"`
+	Extension string    `json:"extension"`
+	Size      int64     `json:"size"`
+	Date      time.Time `json:"date"`
+}
+
+// Reports whether the webhook with the comma-separated event types
+// receives the event type.
+func Subscribed(types, event string) bool {
+	if types == "" {
+		return true
+	}
+	for _, t := range strings.Split(types, ",") {
+		if t == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Saves a pending delivery of the event for every webhook of its user
+// and every admin webhook. Registered as a handler of the event bus, so
+// deliveries are stored before the response of the file operation.
+func Enqueue(e events.Event) {
+	var hooks []models.Webhook
+	dbReq := db.C.Where("user_id IN ?", []uint{e.UserID, 0}).Find(&hooks)
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot find webhooks:", dbReq.Error)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	now := time.Now()
+	payload, err := json.Marshal(Payload{
+		Event:  e.Type,
+		Time:   now,
+		UserID: e.UserID,
+		File: File{
+			ID:        e.File.ID,
+			Name:      e.File.ListName,
+			Extension: e.File.Extension,
+			Size:      e.File.Size,
+			Date:      e.File.Date,
+		},
+	})
+	if err != nil {
+		log.Error(logging.F()+"() payload encoding error:", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !Subscribed(hook.Events, e.Type) {
+			continue
+		}
+		dbReq := db.C.Create(&models.WebhookDelivery{
+			WebhookID:   hook.ID,
+			Event:       e.Type,
+			Payload:     string(payload),
+			Status:      models.DeliveryPending,
+			NextAttempt: now,
+		})
+		if dbReq.Error != nil {
+			log.WithFields(logrus.Fields{
+				"webhook": hook.ID,
+				"event":   e.Type,
+			}).Error(logging.F()+"() cannot save delivery:", dbReq.Error)
+		}
+	}
+}
+
+// Sends the due deliveries every interval until the stop channel is
+// closed. The done channel is closed when the deliveries in progress
+// are complete.
+func Run(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			Deliver(context.Background())
+		}
+	}
+}
+
+// Sends the pending deliveries that are due and returns the number of
+// attempts. Every delivery is leased first by moving its next attempt
+// past the timeout, so other instances skip it and a delivery
+// interrupted by a restart is retried.
+func Deliver(ctx context.Context) int {
+	cfg := config.Get().Webhooks
+	now := time.Now()
+	var due []models.WebhookDelivery
+	dbReq := db.C.WithContext(ctx).
+		Where("status = ? AND next_attempt <= ?", models.DeliveryPending, now).
+		Order("next_attempt").Limit(batch).Find(&due)
+	if dbReq.Error != nil {
+		log.Error(logging.F()+"() cannot find deliveries:", dbReq.Error)
+		return 0
+	}
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, workers)
+	sent := 0
+	for i := range due {
+		delivery := &due[i]
+		lease := db.C.WithContext(ctx).Model(delivery).
+			Where("next_attempt = ?", delivery.NextAttempt).
+			Update("next_attempt", now.Add(2*cfg.Timeout))
+		if lease.Error != nil || lease.RowsAffected == 0 {
+			continue
+		}
+		sent++
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			attempt(ctx, delivery, cfg)
+		}()
+	}
+	wg.Wait()
+	return sent
+}
+
+// Sends the delivery once and saves the result. Deliveries of deleted
+// webhooks are dropped.
+func attempt(ctx context.Context, delivery *models.WebhookDelivery, cfg config.Webhooks) {
+	var hook models.Webhook
+	err := db.C.WithContext(ctx).First(&hook, delivery.WebhookID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		db.C.Delete(delivery)
+		return
+	}
+	if err != nil {
+		log.Error(logging.F()+"() cannot find webhook:", err)
+		return
+	}
+	code, err := send(ctx, &hook, delivery, cfg)
+	now := time.Now()
+	delivery.Attempts++
+	updates := map[string]interface{}{
+		"attempts":      delivery.Attempts,
+		"response_code": code,
+		"error":         "",
+	}
+	switch {
+	case err == nil:
+		updates["status"] = models.DeliveryDelivered
+		updates["delivered_at"] = now
+	case delivery.Attempts >= cfg.MaxAttempts:
+		updates["status"] = models.DeliveryFailed
+		updates["error"] = err.Error()
+	default:
+		updates["next_attempt"] = now.Add(backoff(delivery.Attempts, cfg))
+		updates["error"] = err.Error()
+	}
+	metrics.Webhook(err)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"webhook":  hook.ID,
+			"delivery": delivery.ID,
+			"attempts": delivery.Attempts,
+		}).Warn(logging.F()+"() delivery failed:", err)
+	}
+	if err := db.C.Model(delivery).Updates(updates).Error; err != nil {
+		log.Error(logging.F()+"() cannot save delivery:", err)
+	}
+}
+
+// Posts the payload to the webhook URL and returns the response status
+// code. Only 2xx codes are successful, redirects are not followed.
+func send(
+	ctx context.Context,
+	hook *models.Webhook,
+	delivery *models.WebhookDelivery,
+	cfg config.Webhooks,
+) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, hook.URL, strings.NewReader(delivery.Payload),
+	)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "spa-api-webhook")
+	request.Header.Set(HeaderEvent, delivery.Event)
+	request.Header.Set(HeaderDelivery, strconv.FormatUint(uint64(delivery.ID), 10))
+	request.Header.Set(HeaderTimestamp, timestamp)
+	request.Header.Set(
+		HeaderSignature,
+		"sha256="+Sign(hook.Secret, timestamp, []byte(delivery.Payload)),
+	)
+	client := publicClient
+	if cfg.AllowPrivate {
+		client = privateClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("%w %d", ErrStatus, response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// Returns the hex HMAC-SHA256 of the timestamp and the body joined by a
+// dot. Receivers compute it with the webhook secret and reject old
+// timestamps, so a captured request cannot be replayed.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the delay after the specified number of failed attempts.
+func backoff(attempts int, cfg config.Webhooks) time.Duration {
+	n := float64(attempts - 1)
+	delay := time.Duration(float64(cfg.BackoffBase) * math.Pow(2, n))
+	if delay <= 0 || delay > cfg.BackoffMax {
+		return cfg.BackoffMax
+	}
+	return delay
+}
+
+var (
+	publicClient  = newClient(false)
+	privateClient = newClient(true)
+)
+
+// Returns the HTTP client of deliveries. Addresses are checked after
+// name resolution, so a webhook host cannot point to the internal
+// network unless private addresses are allowed.
+func newClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+				return fmt.Errorf("%w %s", ErrPrivateAddress, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}